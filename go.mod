@@ -1,8 +1,7 @@
 module github.com/rakyll/hey
 
-require (
-	golang.org/x/net v0.0.0-20191009170851-d66e71096ffb
-	golang.org/x/text v0.3.2 // indirect
-)
+require golang.org/x/net v0.17.0
 
-go 1.13
+require golang.org/x/text v0.13.0 // indirect
+
+go 1.17
@@ -0,0 +1,201 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultAbortWindow is the window of abort conditions that do not
+	// set one.
+	defaultAbortWindow = 10 * time.Second
+
+	// abortCheckInterval is how often abort conditions are checked at
+	// most, so that busy runs do not sort the window on every result.
+	abortCheckInterval = 100 * time.Millisecond
+
+	// abortMinResults is the number of results a condition is checked
+	// over before its window fills, so that the first few results of a
+	// run do not stop it on their own.
+	abortMinResults = 20
+)
+
+// AbortCondition stops a run early when a metric of the results of the
+// last Window crosses a bound.
+type AbortCondition struct {
+	// Threshold is the condition that stops the run when it holds, such
+	// as error_rate>20% or p95>5s.
+	*Threshold
+
+	// Window is the sliding window the metric is computed over. The
+	// condition is checked once the run has lasted that long, or earlier
+	// over the results so far once there are at least 20 of them.
+	// Latencies include the requests in flight that have already taken
+	// longer than the bound.
+	Window time.Duration
+}
+
+// ParseAbortCondition parses an abort condition in the form
+// "<metric><op><value> for <window>", for example "error_rate>20% for 10s"
+// or "p95>5s for 30s", with the metrics of ParseThreshold. The window
+// defaults to 10s.
+func ParseAbortCondition(s string) (*AbortCondition, error) {
+	expr, window := s, defaultAbortWindow
+	if i := strings.Index(s, " for "); i >= 0 {
+		expr = s[:i]
+		d, err := time.ParseDuration(strings.TrimSpace(s[i+len(" for "):]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid abort condition %q: invalid window", s)
+		}
+		window = d
+	}
+	t, err := ParseThreshold(strings.TrimSpace(expr))
+	if err != nil {
+		return nil, err
+	}
+	t.Name = s
+	return &AbortCondition{Threshold: t, Window: window}, nil
+}
+
+// Abort is why and when a run was stopped by an abort condition.
+type Abort struct {
+	// Reason is the condition that held, with the value of its metric.
+	Reason string `json:"reason"`
+	// At is the time since the start of the run.
+	At time.Duration `json:"at"`
+}
+
+// windowResult is a result in the window of the abort conditions.
+type windowResult struct {
+	at       time.Duration
+	duration float64
+	err      bool
+	failed   bool
+}
+
+// addAbortResult adds res to the window of the abort conditions and
+// checks them.
+func (r *report) addAbortResult(res *result) {
+	r.window = append(r.window, windowResult{
+		at:       now(),
+		duration: res.duration.Seconds(),
+		err:      res.err != nil,
+		failed:   len(res.failed) > 0,
+	})
+	r.checkAbort()
+}
+
+// checkAbort stops the run if an abort condition holds. It is called on
+// each result and on a ticker, so that latency conditions hold while the
+// requests hang, and checks the conditions every abortCheckInterval at
+// most.
+func (r *report) checkAbort() {
+	t := now()
+	if t-r.lastCheck < abortCheckInterval {
+		return
+	}
+	r.lastCheck = t
+
+	var maxWindow time.Duration
+	for _, c := range r.abortConds {
+		if c.Window > maxWindow {
+			maxWindow = c.Window
+		}
+	}
+	r.window = r.window[r.windowStart(t-maxWindow):]
+	elapsed := t - r.start
+	for _, c := range r.abortConds {
+		window := c.Window
+		results := r.window[r.windowStart(t-window):]
+		var inflight []float64
+		if c.latency() {
+			inflight = r.inflightLats(t, c.Value)
+		}
+		if elapsed < window {
+			if len(results)+len(inflight) < abortMinResults {
+				continue
+			}
+			window = elapsed
+		}
+		rep := r.windowReport(results, inflight, window)
+		if res := c.Check(&rep); res.Pass {
+			r.abort = &Abort{Reason: fmt.Sprintf("%s (%s)", c.Name, res.Observed()), At: t - r.start}
+			r.stop()
+			return
+		}
+	}
+}
+
+// windowStart returns the index of the first result of the window at or
+// after t.
+func (r *report) windowStart(t time.Duration) int {
+	return sort.Search(len(r.window), func(i int) bool {
+		return r.window[i].at >= t
+	})
+}
+
+// inflightLats returns how long the requests in flight at t have taken so
+// far, of those that have taken longer than bound seconds.
+func (r *report) inflightLats(t time.Duration, bound float64) []float64 {
+	var lats []float64
+	for i := range r.inflight {
+		s := atomic.LoadInt64(&r.inflight[i])
+		if s == 0 {
+			continue
+		}
+		if d := (t - time.Duration(s)).Seconds(); d > bound {
+			lats = append(lats, d)
+		}
+	}
+	return lats
+}
+
+// windowReport returns the report of the results of a window and the
+// latencies of the requests in flight, with the fields thresholds are
+// checked against.
+func (r *report) windowReport(results []windowResult, inflight []float64, window time.Duration) Report {
+	rps := float64(len(results)) / window.Seconds()
+	rep := Report{Rps: rps, AggregateRps: rps}
+	var errors int
+	for _, res := range results {
+		if res.err {
+			errors++
+			continue
+		}
+		rep.Lats = append(rep.Lats, res.duration)
+		rep.AvgTotal += res.duration
+		if res.failed {
+			rep.FailedResponses++
+		}
+	}
+	for _, d := range inflight {
+		rep.Lats = append(rep.Lats, d)
+		rep.AvgTotal += d
+	}
+	if errors > 0 {
+		rep.ErrorDist = map[string]int{"": errors}
+	}
+	if n := len(rep.Lats); n > 0 {
+		sort.Float64s(rep.Lats)
+		rep.AvgTotal /= float64(n)
+		rep.Fastest, rep.Slowest = rep.Lats[0], rep.Lats[n-1]
+	}
+	return rep
+}
@@ -0,0 +1,199 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogEntry is a request read from an access log.
+type LogEntry struct {
+	Time   time.Time
+	Method string
+	// URI is the request URI, the path and the query.
+	URI string
+}
+
+// combinedRegexp matches the NCSA common and combined log formats of nginx
+// and Apache:
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /a.gif HTTP/1.0" 200 2326 "-" "curl/7.64"
+var combinedRegexp = regexp.MustCompile(`^\S+ \S+ .*?\[([^\]]+)\] "([A-Z]+) (\S+)[^"]*"`)
+
+const logTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// JSON access log fields, by order of preference.
+var (
+	jsonTimeKeys   = []string{"time", "timestamp", "@timestamp", "time_iso8601", "time_local", "ts"}
+	jsonMethodKeys = []string{"method", "request_method", "verb"}
+	jsonURIKeys    = []string{"uri", "request_uri", "path", "url"}
+)
+
+// ReadAccessLog reads the requests of an access log in the combined log
+// format of nginx and Apache, or in JSON with one object per line. The
+// format is detected on each line. Lines that are not requests, such as
+// the ones of malformed requests, are skipped and counted. The entries
+// are returned in time order.
+func ReadAccessLog(path string) (entries []*LogEntry, skipped int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var e *LogEntry
+		if strings.HasPrefix(line, "{") {
+			e = parseJSONLogLine(line)
+		} else {
+			e = parseCombinedLogLine(line)
+		}
+		if e == nil {
+			skipped++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(entries) == 0 {
+		return nil, skipped, fmt.Errorf("%s: no requests", path)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, skipped, nil
+}
+
+func parseCombinedLogLine(line string) *LogEntry {
+	m := combinedRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	t, err := time.Parse(logTimeLayout, m[1])
+	if err != nil {
+		return nil
+	}
+	uri, ok := requestURI(m[3])
+	if !ok {
+		return nil
+	}
+	return &LogEntry{Time: t, Method: m[2], URI: uri}
+}
+
+func parseJSONLogLine(line string) *LogEntry {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return nil
+	}
+	e := &LogEntry{}
+	v, ok := lookup(fields, jsonTimeKeys)
+	if !ok {
+		return nil
+	}
+	if e.Time, ok = parseLogTime(v); !ok {
+		return nil
+	}
+	method, _ := lookup(fields, jsonMethodKeys)
+	uri, _ := lookup(fields, jsonURIKeys)
+	if method == nil || uri == nil {
+		// nginx's $request, "GET /a.gif HTTP/1.1".
+		s, _ := fields["request"].(string)
+		parts := strings.Fields(s)
+		if len(parts) < 2 {
+			return nil
+		}
+		method, uri = parts[0], parts[1]
+	}
+	e.Method, _ = method.(string)
+	s, _ := uri.(string)
+	if e.URI, ok = requestURI(s); !ok || e.Method == "" {
+		return nil
+	}
+	e.Method = strings.ToUpper(e.Method)
+	return e
+}
+
+func lookup(fields map[string]interface{}, keys []string) (interface{}, bool) {
+	for _, k := range keys {
+		if v, ok := fields[k]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// parseLogTime parses a time in RFC 3339, in the log format of nginx and
+// Apache, or as a number of seconds or milliseconds since the epoch.
+func parseLogTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		if v > 1e11 {
+			v /= 1000
+		}
+		sec := int64(v)
+		return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, logTimeLayout, "2006-01-02 15:04:05.999999999"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return parseLogTime(f)
+		}
+	}
+	return time.Time{}, false
+}
+
+// requestURI returns the request URI of a logged request target, which
+// may be an absolute URL.
+func requestURI(target string) (string, bool) {
+	if strings.HasPrefix(target, "/") {
+		return target, true
+	}
+	u, err := url.Parse(target)
+	if err != nil || !u.IsAbs() {
+		return "", false
+	}
+	return u.RequestURI(), true
+}
+
+// ReplaySchedule returns the time at which each of entries is sent,
+// relative to the first one, keeping their original spacing sped up by
+// speed. A speed of 2 replays the log twice as fast.
+func ReplaySchedule(entries []*LogEntry, speed float64) []time.Duration {
+	sched := make([]time.Duration, len(entries))
+	for i, e := range entries {
+		sched[i] = time.Duration(float64(e.Time.Sub(entries[0].Time)) / speed)
+	}
+	return sched
+}
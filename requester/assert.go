@@ -0,0 +1,242 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Assertion kinds.
+const (
+	AssertStatus       = "status"
+	AssertHeader       = "header"
+	AssertBodyContains = "body-contains"
+	AssertBodyRegexp   = "body-regexp"
+	AssertJSONPath     = "jsonpath"
+	AssertMaxSize      = "max-size"
+)
+
+// Assertion is a check of the responses. A request whose response fails
+// an assertion still counts as a response, its failure is reported apart
+// from the transport errors.
+type Assertion struct {
+	// Name is the assertion as parsed, failures are reported under it.
+	Name string
+
+	kind     string
+	statuses [][2]int // ranges of accepted status codes
+	header   string
+	value    string
+	re       *regexp.Regexp
+	path     []interface{}
+	maxSize  int64
+}
+
+// response is a response the assertions are checked against.
+type response struct {
+	resp *http.Response
+	body []byte
+	size int64 // size of the body, which may be larger than body
+
+	doc    interface{}
+	docErr error
+	parsed bool
+}
+
+// json returns the body decoded as JSON.
+func (r *response) json() (interface{}, error) {
+	if !r.parsed {
+		d := json.NewDecoder(bytes.NewReader(r.body))
+		d.UseNumber()
+		r.docErr = d.Decode(&r.doc)
+		r.parsed = true
+	}
+	return r.doc, r.docErr
+}
+
+// ParseAssertion parses an assertion in the form "<kind>:<args>":
+//
+//	status:2xx                       status code in 200-299
+//	status:200-204,304               status code in one of the ranges
+//	header:Content-Type              header is present
+//	header:Content-Type=text/html    header has the value
+//	header:Content-Type~json         header matches the regular expression
+//	body-contains:"ok"               body contains the text
+//	body-regexp:^\{"id":\d+          body matches the regular expression
+//	jsonpath:$.status=ok             JSON value at the path equals the text
+//	max-size:64KB                    body is at most 64 KB, in B, KB or MB
+//
+// Bodies are checked up to their first 10 MB.
+func ParseAssertion(s string) (*Assertion, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid assertion %q, want <kind>:<args>", s)
+	}
+	a := &Assertion{Name: s, kind: s[:i]}
+	args := s[i+1:]
+	var err error
+	switch a.kind {
+	case AssertStatus:
+		a.statuses, err = parseStatusRanges(args)
+	case AssertHeader:
+		a.header = args
+		if j := strings.IndexAny(args, "=~"); j >= 0 {
+			a.header, a.value = args[:j], args[j+1:]
+			if args[j] == '~' {
+				a.re, err = regexp.Compile(a.value)
+			}
+		}
+		if a.header == "" {
+			err = fmt.Errorf("missing header name")
+		}
+	case AssertBodyContains:
+		a.value = args
+	case AssertBodyRegexp:
+		a.re, err = regexp.Compile(args)
+	case AssertJSONPath:
+		j := strings.Index(args, "=")
+		if j < 0 {
+			return nil, fmt.Errorf("invalid assertion %q, want jsonpath:<path>=<value>", s)
+		}
+		a.value = args[j+1:]
+		a.path, err = parseJSONPath(args[:j])
+	case AssertMaxSize:
+		a.maxSize, err = parseSize(args)
+	default:
+		return nil, fmt.Errorf("invalid assertion %q, want one of status, header, body-contains, body-regexp, jsonpath or max-size", s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid assertion %q: %v", s, err)
+	}
+	return a, nil
+}
+
+// parseStatusRanges parses comma-separated status codes, ranges such as
+// 200-204 and classes such as 2xx.
+func parseStatusRanges(s string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		var lo, hi int
+		var err error
+		switch {
+		case len(f) == 3 && strings.HasSuffix(strings.ToLower(f), "xx"):
+			lo, err = strconv.Atoi(f[:1])
+			lo *= 100
+			hi = lo + 99
+		case strings.Contains(f, "-"):
+			j := strings.Index(f, "-")
+			if lo, err = strconv.Atoi(f[:j]); err == nil {
+				hi, err = strconv.Atoi(f[j+1:])
+			}
+		default:
+			lo, err = strconv.Atoi(f)
+			hi = lo
+		}
+		if err != nil || lo > hi {
+			return nil, fmt.Errorf("invalid status code range %q", f)
+		}
+		ranges = append(ranges, [2]int{lo, hi})
+	}
+	return ranges, nil
+}
+
+// parseSize parses a size in bytes, with an optional B, KB or MB unit.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// needsBody reports whether the assertion checks the body.
+func (a *Assertion) needsBody() bool {
+	switch a.kind {
+	case AssertBodyContains, AssertBodyRegexp, AssertJSONPath:
+		return true
+	}
+	return false
+}
+
+// check reports whether r passes the assertion.
+func (a *Assertion) check(r *response) bool {
+	switch a.kind {
+	case AssertStatus:
+		for _, rg := range a.statuses {
+			if r.resp.StatusCode >= rg[0] && r.resp.StatusCode <= rg[1] {
+				return true
+			}
+		}
+		return false
+	case AssertHeader:
+		vs, ok := r.resp.Header[http.CanonicalHeaderKey(a.header)]
+		if !ok || a.value == "" && a.re == nil {
+			return ok
+		}
+		for _, v := range vs {
+			if a.re != nil && a.re.MatchString(v) || a.re == nil && v == a.value {
+				return true
+			}
+		}
+		return false
+	case AssertBodyContains:
+		return bytes.Contains(r.body, []byte(a.value))
+	case AssertBodyRegexp:
+		return a.re.Match(r.body)
+	case AssertJSONPath:
+		doc, err := r.json()
+		if err != nil {
+			return false
+		}
+		v, ok := jsonLookup(doc, a.path)
+		return ok && v == a.value
+	case AssertMaxSize:
+		return r.size <= a.maxSize
+	}
+	return true
+}
+
+func (a *Assertion) String() string {
+	return a.Name
+}
+
+// checkAssertions returns the names of the assertions r fails.
+func (b *Work) checkAssertions(r *response) []string {
+	var failed []string
+	for _, a := range b.Assertions {
+		if !a.check(r) {
+			failed = append(failed, a.Name)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpOnlyPrefix marks the HttpOnly cookies of a cookie file.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// SeedCookie is a cookie the cookie jar of each worker starts with.
+type SeedCookie struct {
+	*http.Cookie
+
+	// Host is the host the cookie is set for. A cookie with an empty
+	// Domain is only sent to Host, not to its subdomains.
+	Host string
+}
+
+// ReadCookieFile reads the cookies of a cookie file in the Netscape
+// format written by curl and browser extensions, one cookie per line with
+// the tab-separated fields domain, include subdomains, path, secure,
+// expiry time and name and value:
+//
+//	.example.com	TRUE	/	FALSE	0	session	abc123
+//
+// A cookie whose domain does not include subdomains is a host-only cookie
+// and has an empty Domain.
+func ReadCookieFile(path string) ([]*SeedCookie, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cookies []*SeedCookie
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		line = strings.TrimPrefix(line, httpOnlyPrefix)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// Cookie with an empty value.
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: want 7 tab-separated fields, found %d", path, n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid expiry time %q", path, n, fields[4])
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		c := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = host
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, &SeedCookie{Cookie: c, Host: host})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
+
+// newJar returns a cookie jar holding SeedCookies.
+func (b *Work) newJar() http.CookieJar {
+	// The jar only fails with invalid options.
+	jar, _ := cookiejar.New(nil)
+	for _, c := range b.SeedCookies {
+		u := &url.URL{Scheme: "http", Host: c.Host, Path: c.Path}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		jar.SetCookies(u, []*http.Cookie{c.Cookie})
+	}
+	return jar
+}
+
+// workerClient returns the client of a worker, c with a cookie jar of the
+// worker's own if Cookies is set.
+func (b *Work) workerClient(c *http.Client) *http.Client {
+	if !b.Cookies {
+		return c
+	}
+	wc := *c
+	wc.Jar = b.newJar()
+	return &wc
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Error categories, the keys errors are counted under.
+const (
+	ErrDNS              = "DNS failure"
+	ErrProxy            = "proxy error"
+	ErrCancelled        = "cancelled"
+	ErrTimeout          = "client timeout"
+	ErrTLS              = "TLS error"
+	ErrTooManyOpenFiles = "too many open files"
+	ErrLocalAddr        = "local address or port not available (EADDRNOTAVAIL/EADDRINUSE)"
+	ErrRefused          = "connection refused"
+	ErrReset            = "connection reset"
+	ErrEOF              = "EOF"
+	ErrOther            = "other"
+)
+
+// maxErrorSamples is the number of distinct messages kept per category.
+const maxErrorSamples = 3
+
+// stepError is a failed check of a scenario step, an assertion or an
+// extraction. Its message names the check rather than the target, so it is
+// a category of its own.
+type stepError struct {
+	msg string
+}
+
+func (e *stepError) Error() string { return e.msg }
+
+// errorKey returns the category err is counted under, so that errors are
+// grouped whatever the remote address or port and can be merged across
+// servers. The message of err is kept as a sample of its category.
+func errorKey(err error) string {
+	var stepErr *stepError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var pErr *proxyError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	msg := err.Error()
+	switch {
+	case errors.As(err, &stepErr):
+		return stepErr.msg
+	case errors.As(err, &dnsErr):
+		return ErrDNS
+	case errors.As(err, &pErr) || errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return ErrProxy
+	case errors.Is(err, context.Canceled):
+		return ErrCancelled
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	case errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || strings.Contains(msg, "tls: ") || strings.Contains(msg, "x509: "):
+		return ErrTLS
+	case errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE):
+		return ErrTooManyOpenFiles
+	case errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE):
+		return ErrLocalAddr
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrRefused
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE):
+		return ErrReset
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || strings.HasSuffix(msg, "EOF"):
+		return ErrEOF
+	}
+	return ErrOther
+}
+
+// addErrorSample adds msg to the samples of category in samples, unless
+// it has enough of them.
+func addErrorSample(samples map[string][]string, category, msg string) {
+	s := samples[category]
+	if len(s) >= maxErrorSamples {
+		return
+	}
+	for _, m := range s {
+		if m == msg {
+			return
+		}
+	}
+	samples[category] = append(s, msg)
+}
@@ -0,0 +1,213 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// harFile is the part of a HAR 1.2 file that is imported.
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method   string         `json:"method"`
+				URL      string         `json:"url"`
+				Headers  []harNameValue `json:"headers"`
+				PostData *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+					Params   []struct {
+						Name        string `json:"name"`
+						Value       string `json:"value"`
+						FileName    string `json:"fileName"`
+						ContentType string `json:"contentType"`
+					} `json:"params"`
+				} `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Content struct {
+					MimeType string `json:"mimeType"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARFilter selects the entries imported from a HAR file. Empty fields
+// select all entries.
+type HARFilter struct {
+	// Hosts are the host names of the entries to import.
+	Hosts []string
+
+	// ContentTypes are the media types of the responses of the entries
+	// to import, such as "application/json". A type ending with "/"
+	// matches all its subtypes, for example "text/".
+	ContentTypes []string
+}
+
+// SkippedEntry is an entry of a HAR file that cannot be replayed.
+type SkippedEntry struct {
+	// Index is the position of the entry in the HAR file, from 0.
+	Index  int
+	Method string
+	URL    string
+	Reason string
+}
+
+func (e SkippedEntry) String() string {
+	return fmt.Sprintf("entry %d, %s %s: %s", e.Index, e.Method, e.URL, e.Reason)
+}
+
+// harDroppedHeaders are the captured headers that are set by the
+// transport, not copied from the HAR file.
+var harDroppedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+	"Keep-Alive":        true,
+	"Upgrade":           true,
+}
+
+// ReadHAR reads the requests of the entries of a HAR file that match f,
+// in the order of the file. Entries that cannot be replayed, such as
+// WebSocket connections or file uploads whose content is not captured,
+// are returned as skipped entries.
+func ReadHAR(path string, f HARFilter) ([]*RequestLine, []SkippedEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var lines []*RequestLine
+	var skipped []SkippedEntry
+	for i, e := range har.Log.Entries {
+		req := e.Request
+		u, err := url.Parse(req.URL)
+		if err == nil && !f.match(u.Hostname(), e.Response.Content.MimeType) {
+			continue
+		}
+		skip := func(reason string) {
+			skipped = append(skipped, SkippedEntry{Index: i, Method: req.Method, URL: req.URL, Reason: reason})
+		}
+		switch {
+		case err != nil:
+			skip(err.Error())
+			continue
+		case u.Scheme != "http" && u.Scheme != "https":
+			skip(fmt.Sprintf("unsupported scheme %q", u.Scheme))
+			continue
+		case req.Method == "CONNECT":
+			skip("CONNECT requests are made by the transport")
+			continue
+		}
+
+		l := &RequestLine{Method: req.Method, URL: req.URL, Headers: make(map[string]string), Weight: 1}
+		for _, h := range req.Headers {
+			name := http.CanonicalHeaderKey(h.Name)
+			switch {
+			case strings.HasPrefix(h.Name, ":"):
+				// HTTP/2 pseudo-headers.
+				continue
+			case name == "Upgrade" && strings.EqualFold(h.Value, "websocket"):
+				err = fmt.Errorf("WebSocket connections are not supported")
+			case harDroppedHeaders[name]:
+				continue
+			}
+			sep := ", "
+			if name == "Cookie" {
+				sep = "; "
+			}
+			if v, ok := l.Headers[name]; ok {
+				l.Headers[name] = v + sep + h.Value
+			} else {
+				l.Headers[name] = h.Value
+			}
+		}
+		if err != nil {
+			skip(err.Error())
+			continue
+		}
+		if pd := req.PostData; pd != nil {
+			if pd.MimeType != "" && l.Headers["Content-Type"] == "" {
+				l.Headers["Content-Type"] = pd.MimeType
+			}
+			switch {
+			case pd.Text != "":
+				l.Body = pd.Text
+			case len(pd.Params) > 0:
+				form := make(url.Values)
+				for _, p := range pd.Params {
+					if p.FileName != "" {
+						err = fmt.Errorf("content of uploaded file %q is not captured", p.FileName)
+						break
+					}
+					form.Add(p.Name, p.Value)
+				}
+				if err == nil && !strings.HasPrefix(pd.MimeType, "application/x-www-form-urlencoded") {
+					err = fmt.Errorf("body of type %q is not captured", pd.MimeType)
+				}
+				l.Body = form.Encode()
+			}
+			if err != nil {
+				skip(err.Error())
+				continue
+			}
+		}
+		lines = append(lines, l)
+	}
+	return lines, skipped, nil
+}
+
+func (f HARFilter) match(host, contentType string) bool {
+	if len(f.Hosts) > 0 {
+		found := false
+		for _, h := range f.Hosts {
+			found = found || strings.EqualFold(h, host)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.ContentTypes) > 0 {
+		// Drop parameters such as "; charset=utf-8".
+		if i := strings.Index(contentType, ";"); i >= 0 {
+			contentType = contentType[:i]
+		}
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		for _, t := range f.ContentTypes {
+			t = strings.ToLower(t)
+			if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
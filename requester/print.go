@@ -24,7 +24,7 @@ human-readable format, including:
 
 The comma-separated CSV format is proceeded by a header, and consists of the following columns:
 1. response-time:	Total time taken for request (in seconds)
-2. DNS+dialup:		Time taken to establish the TCP connection (in seconds)
+2. DNS+dialup:		Time taken to establish the TCP connection, without the proxy tunnel and TLS handshake (in seconds)
 3. DNS:				Time taken to do the DNS lookup (in seconds)
 4. Request-write:	Time taken to write full request (in seconds)
 5. Response-delay: 	Time taken to first byte received (in seconds)
@@ -51,11 +51,21 @@ func PrintReport(r Report) error {
 	return nil
 }
 
+// PrintReportJSON prints r as indented JSON, with the same summaries,
+// distributions and breakdowns as PrintReport.
+func PrintReportJSON(r Report) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(r)
+}
+
 var tmplFuncMap = template.FuncMap{
 	"formatNumber":    formatNumber,
 	"formatNumberInt": formatNumberInt,
+	"formatPercent":   formatPercent,
 	"histogram":       histogram,
 	"jsonify":         jsonify,
+	"percentile":      percentile,
 }
 
 func jsonify(v interface{}) string {
@@ -63,10 +73,25 @@ func jsonify(v interface{}) string {
 	return string(d)
 }
 
+// percentile returns the latency of the percentage p of dist, or 0 if it
+// is not known.
+func percentile(dist []LatencyDistribution, p int) float64 {
+	for _, d := range dist {
+		if d.Percentage == p {
+			return d.Latency
+		}
+	}
+	return 0
+}
+
 func formatNumber(duration float64) string {
 	return fmt.Sprintf("%4.4f", duration)
 }
 
+func formatPercent(ratio float64) string {
+	return fmt.Sprintf("%.2f%%", ratio*100)
+}
+
 func formatNumberInt(duration int) string {
 	return fmt.Sprintf("%d", duration)
 }
@@ -97,10 +122,14 @@ Summary:
   Slowest:	{{ formatNumber .Slowest }} secs
   Fastest:	{{ formatNumber .Fastest }} secs
   Requests/sec:	{{ formatNumber .Rps }}
+  Offered rate:	{{ formatNumber .OfferedRate }} requests/sec
   {{ if gt .SizeTotal 0 }}
   Total data:	{{ .SizeTotal }} bytes
   Size/request:	{{ .SizeReq }} bytes{{ end }}
-
+{{ if gt (len .Aborts) 0 }}
+Aborted:{{ range .Aborts }}
+  after {{ formatNumber .At.Seconds }} secs: {{ .Reason }}{{ end }}
+{{ end }}
 Response time histogram:
 {{ histogram .Histogram }}
 
@@ -110,16 +139,74 @@ Latency distribution:{{ range .LatencyDistribution }}
 Details (average, fastest, slowest):
   DNS+dialup:	{{ formatNumber .AvgConn }} secs, {{ formatNumber .ConnMax }} secs, {{ formatNumber .ConnMin }} secs
   DNS-lookup:	{{ formatNumber .AvgDNS }} secs, {{ formatNumber .DnsMax }} secs, {{ formatNumber .DnsMin }} secs
+  proxy CONNECT:	{{ formatNumber .ProxyConnect.Average }} secs, {{ formatNumber .ProxyConnect.Fastest }} secs, {{ formatNumber .ProxyConnect.Slowest }} secs
+  TLS handshake:	{{ formatNumber .TLSHandshake.Average }} secs, {{ formatNumber .TLSHandshake.Fastest }} secs, {{ formatNumber .TLSHandshake.Slowest }} secs
   req write:	{{ formatNumber .AvgReq }} secs, {{ formatNumber .ReqMax }} secs, {{ formatNumber .ReqMin }} secs
   resp wait:	{{ formatNumber .AvgDelay }} secs, {{ formatNumber .DelayMax }} secs, {{ formatNumber .DelayMin }} secs
   resp read:	{{ formatNumber .AvgRes }} secs, {{ formatNumber .ResMax }} secs, {{ formatNumber .ResMin }} secs
 
-Status code distribution:{{ range $code, $num := .StatusCodeDist }}
+Connections:
+  Opened:	{{ .ConnsOpened }}
+  New:	{{ .NewConnRequests }} requests
+  Reused:	{{ .ReusedConnRequests }} requests
+  Used:	{{ .ConnLoad.Conns }}
+  Requests/conn:	{{ formatNumber .ConnLoad.AvgRequests }} average, {{ .ConnLoad.MaxRequests }} max
+  Peak streams/conn:	{{ formatNumber .ConnLoad.AvgPeakStreams }} average, {{ .ConnLoad.MaxPeakStreams }} max
+{{ if gt (len .IdleTimeDistribution) 0 }}
+Idle time of reused connections:{{ range .IdleTimeDistribution }}{{ if gt .Percentage 0 }}
+  {{ .Percentage }}% in {{ formatNumber .Latency }} secs{{ end }}{{ end }}
+{{ end }}
+Latency by connection (average, fastest, slowest):
+  new:	{{ formatNumber .NewConnLatency.Average }} secs, {{ formatNumber .NewConnLatency.Fastest }} secs, {{ formatNumber .NewConnLatency.Slowest }} secs
+  reused:	{{ formatNumber .ReusedConnLatency.Average }} secs, {{ formatNumber .ReusedConnLatency.Fastest }} secs, {{ formatNumber .ReusedConnLatency.Slowest }} secs
+
+{{ if gt .ScheduleDrift.Count 0 }}Schedule drift (average, smallest, largest):
+  {{ formatNumber .ScheduleDrift.Average }} secs, {{ formatNumber .ScheduleDrift.Fastest }} secs, {{ formatNumber .ScheduleDrift.Slowest }} secs{{ range .ScheduleDrift.LatencyDistribution }}{{ if gt .Percentage 0 }}
+  {{ .Percentage }}% in {{ formatNumber .Latency }} secs{{ end }}{{ end }}
+
+{{ end }}{{ if gt .TLSHandshakes 0 }}TLS:
+  Handshakes:	{{ .TLSHandshakes }}
+  Resumed:	{{ .TLSResumed }} ({{ formatPercent .TLSResumptionRate }})
+  Handshake latency:{{ range .TLSHandshake.LatencyDistribution }}{{ if gt .Percentage 0 }}
+    {{ .Percentage }}% in {{ formatNumber .Latency }} secs{{ end }}{{ end }}
+  Versions:{{ range $v, $num := .TLSVersions }}
+    [{{ $v }}]	{{ $num }} handshakes{{ end }}
+  Cipher suites:{{ range $c, $num := .TLSCipherSuites }}
+    [{{ $c }}]	{{ $num }} handshakes{{ end }}
+  ALPN protocols:{{ range $p, $num := .ALPNProtocols }}
+    [{{ $p }}]	{{ $num }} handshakes{{ end }}
+
+{{ end }}{{ if gt (len .EndpointStats) 0 }}Endpoints:{{ range .EndpointStats }}
+  [{{ .Name }}]
+    Requests:	{{ .Requests }} ({{ formatPercent .Share }}), {{ .Errors }} errors
+    Latency:	{{ formatNumber .Latency.Average }} secs average, {{ formatNumber (percentile .Latency.LatencyDistribution 50) }} secs p50, {{ formatNumber (percentile .Latency.LatencyDistribution 95) }} secs p95, {{ formatNumber (percentile .Latency.LatencyDistribution 99) }} secs p99
+    Status codes:{{ range $code, $num := .StatusCodeDist }} [{{ $code }}] {{ $num }}{{ end }}
+    Histogram:
+{{ histogram .Histogram }}{{ end }}
+{{ end }}{{ if gt (len .StatusClassLatency) 1 }}Latency by status class:{{ range .StatusClassLatency }}
+  [{{ .Name }}]	{{ .Latency.Count }} responses, {{ formatNumber .Latency.Average }} secs average, {{ formatNumber (percentile .Latency.LatencyDistribution 50) }} secs p50, {{ formatNumber (percentile .Latency.LatencyDistribution 95) }} secs p95, {{ formatNumber (percentile .Latency.LatencyDistribution 99) }} secs p99
+{{ histogram .Histogram }}{{ end }}
+{{ end }}{{ if or (gt .Iterations.Count 0) (gt (len .IterationErrors) 0) }}Iterations:
+  Completed:	{{ .Iterations.Count }}
+  Duration:	{{ formatNumber .Iterations.Average }} secs average, {{ formatNumber .Iterations.Fastest }} secs fastest, {{ formatNumber .Iterations.Slowest }} secs slowest{{ if gt (len .IterationErrors) 0 }}
+  Failed:{{ $samples := .IterationErrorSamples }}{{ range $err, $num := .IterationErrors }}
+    [{{ $num }}]	{{ $err }}{{ range index $samples $err }}
+        {{ . }}{{ end }}{{ end }}{{ end }}
+
+{{ end }}{{ if gt .FailedResponses 0 }}Assertion failures:
+  Failed responses:	{{ .FailedResponses }}{{ range $a, $num := .AssertionFailures }}
+  [{{ $num }}]	{{ $a }}{{ end }}
+
+{{ end }}Status code distribution:{{ range $code, $num := .StatusCodeDist }}
   [{{ $code }}]	{{ $num }} responses{{ end }}
 
-{{ if gt (len .ErrorDist) 0 }}Error distribution:{{ range $err, $num := .ErrorDist }}
-  [{{ $num }}]	{{ $err }}{{ end }}{{ end }}
-`
+{{ if gt (len .ErrorDist) 0 }}Error distribution:{{ $samples := .ErrorSamples }}{{ range $err, $num := .ErrorDist }}
+  [{{ $num }}]	{{ $err }}{{ range index $samples $err }}
+      {{ . }}{{ end }}{{ end }}
+
+{{ end }}{{ if gt (len .Thresholds) 0 }}Thresholds:{{ range .Thresholds }}
+  [{{ if .Pass }}pass{{ else }}FAIL{{ end }}]	{{ .Name }}	({{ .Observed }}){{ end }}
+{{ end }}`
 	csvTmpl = `{{ $connLats := .ConnLats }}{{ $dnsLats := .DnsLats }}{{ $dnsLats := .DnsLats }}{{ $reqLats := .ReqLats }}{{ $delayLats := .DelayLats }}{{ $resLats := .ResLats }}{{ $statusCodeLats := .StatusCodes }}{{ $offsets := .Offsets}}response-time,DNS+dialup,DNS,Request-write,Response-delay,Response-read,status-code,offset{{ range $i, $v := .Lats }}
 {{ formatNumber $v }},{{ formatNumber (index $connLats $i) }},{{ formatNumber (index $dnsLats $i) }},{{ formatNumber (index $reqLats $i) }},{{ formatNumber (index $delayLats $i) }},{{ formatNumber (index $resLats $i) }},{{ formatNumberInt (index $statusCodeLats $i) }},{{ formatNumber (index $offsets $i) }}{{ end }}`
 )
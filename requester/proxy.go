@@ -0,0 +1,195 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyTimingKey is the context key of the *int64 the duration in
+// nanoseconds of the proxy phase, the tunnel or the connection to an HTTPS
+// proxy, is stored into.
+type proxyTimingKey struct{}
+
+// proxyError is an error opening a tunnel through the proxy, rather than
+// an error of the target.
+type proxyError struct {
+	err error
+}
+
+func (e *proxyError) Error() string { return e.err.Error() }
+func (e *proxyError) Unwrap() error { return e.err }
+
+// isSOCKSProxy reports whether u is a SOCKS5 proxy.
+func isSOCKSProxy(u *url.URL) bool {
+	return u.Scheme == "socks5" || u.Scheme == "socks5h"
+}
+
+// proxyFunc is the Proxy of the transports. Plain HTTP requests are
+// sent to HTTP proxies by the transport itself. All other requests are
+// tunneled through the proxy by dialContext.
+func (b *Work) proxyFunc(req *http.Request) (*url.URL, error) {
+	if b.ProxyAddr == nil || isSOCKSProxy(b.ProxyAddr) || req.URL.Scheme == "https" {
+		return nil, nil
+	}
+	if b.ProxyAddr.Scheme == "https" {
+		// dialContext does the TLS handshake with an HTTPS proxy, with the
+		// settings of the proxy rather than those of the target, so the
+		// transport sees a plain HTTP proxy.
+		u := *b.ProxyAddr
+		u.Scheme, u.Host = "http", b.proxyHostPort()
+		return &u, nil
+	}
+	return b.ProxyAddr, nil
+}
+
+// proxyHostPort returns the address of the proxy, with the default port
+// of its scheme if the URL has none.
+func (b *Work) proxyHostPort() string {
+	if b.ProxyAddr.Port() != "" {
+		return b.ProxyAddr.Host
+	}
+	port := "80"
+	switch b.ProxyAddr.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(b.ProxyAddr.Hostname(), port)
+}
+
+// dialProxy opens a tunnel to addr through the proxy, or a connection to
+// the proxy if addr is the proxy, and records how long it took in the proxy
+// timing of ctx, if any.
+func (b *Work) dialProxy(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := now()
+	var conn net.Conn
+	var err error
+	switch {
+	case addr == b.proxyHostPort():
+		// The transport sends plain HTTP requests to the proxy.
+		conn, err = b.dialProxyConn(ctx)
+	case isSOCKSProxy(b.ProxyAddr):
+		conn, err = b.dialSOCKS(ctx, network, addr)
+	default:
+		conn, err = b.dialConnect(ctx, addr)
+	}
+	if err != nil {
+		return nil, &proxyError{err}
+	}
+	if d, ok := ctx.Value(proxyTimingKey{}).(*int64); ok {
+		atomic.StoreInt64(d, int64(now()-start))
+	}
+	return conn, nil
+}
+
+func (b *Work) dialSOCKS(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u := b.ProxyAddr.User; u != nil {
+		password, _ := u.Password()
+		auth = &proxy.Auth{User: u.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", b.proxyHostPort(), auth, directDialer{b})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// dialProxyConn dials an HTTP proxy, and does the TLS handshake with the
+// proxy's host name if it is an HTTPS proxy.
+func (b *Work) dialProxyConn(ctx context.Context) (net.Conn, error) {
+	conn, err := b.dialDirect(ctx, "tcp", b.proxyHostPort())
+	if err != nil || b.ProxyAddr.Scheme != "https" {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         b.ProxyAddr.Hostname(),
+		InsecureSkipVerify: !b.TLSVerify,
+		RootCAs:            b.RootCAs,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request to an
+// HTTP or HTTPS proxy.
+func (b *Work) dialConnect(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := b.dialProxyConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := b.ProxyAddr.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The target doesn't speak before the client, so nothing past the
+	// response is buffered by the reader.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The body of a successful response is the tunnel, it is not read.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// directDialer dials without going through the proxy.
+type directDialer struct {
+	b *Work
+}
+
+func (d directDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.b.dialDirect(context.Background(), network, addr)
+}
+
+func (d directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.b.dialDirect(ctx, network, addr)
+}
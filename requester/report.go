@@ -15,6 +15,7 @@
 package requester
 
 import (
+	"crypto/tls"
 	"io"
 	"time"
 )
@@ -45,16 +46,51 @@ type report struct {
 	delayLats   []float64
 	offsets     []float64
 	statusCodes []int
+	connReused  []bool
+	idleTimes   []float64
+	tlsLats     []float64
+	proxyLats   []float64
+	drifts      []float64
+	endpoints   []int
+
+	endpointErrors map[int]int
+
+	iterationLats         []float64
+	iterationErrors       map[string]int
+	iterationErrorSamples map[string][]string
+
+	failedRes         int64
+	assertionFailures map[string]int
+
+	// The abort conditions are checked over the window of the latest
+	// results and the requests in flight, the start of the request of each
+	// worker or 0. stop stops the run when one holds.
+	abortConds []*AbortCondition
+	start      time.Duration
+	stop       func()
+	inflight   []int64
+	window     []windowResult
+	lastCheck  time.Duration
+	abort      *Abort
+
+	connsOpened int64
+
+	tlsHandshakes   int64
+	tlsResumed      int64
+	tlsVersions     map[string]int
+	tlsCipherSuites map[string]int
+	alpnProtocols   map[string]int
 
 	results chan *result
 	done    chan bool
 	total   time.Duration
 
-	errorDist map[string]int
-	lats      []float64
-	sizeTotal int64
-	numRes    int64
-	output    string
+	errorDist    map[string]int
+	errorSamples map[string][]string
+	lats         []float64
+	sizeTotal    int64
+	numRes       int64
+	output       string
 
 	w io.Writer
 }
@@ -62,64 +98,159 @@ type report struct {
 func newReport(w io.Writer, results chan *result, output string, n int) *report {
 	cap := min(n, maxRes)
 	return &report{
-		output:      output,
-		results:     results,
-		done:        make(chan bool, 1),
-		errorDist:   make(map[string]int),
-		w:           w,
-		connLats:    make([]float64, 0, cap),
-		dnsLats:     make([]float64, 0, cap),
-		reqLats:     make([]float64, 0, cap),
-		resLats:     make([]float64, 0, cap),
-		delayLats:   make([]float64, 0, cap),
-		lats:        make([]float64, 0, cap),
-		statusCodes: make([]int, 0, cap),
+		output:       output,
+		results:      results,
+		done:         make(chan bool, 1),
+		errorDist:    make(map[string]int),
+		errorSamples: make(map[string][]string),
+		w:            w,
+
+		endpointErrors:        make(map[int]int),
+		iterationErrors:       make(map[string]int),
+		iterationErrorSamples: make(map[string][]string),
+
+		assertionFailures: make(map[string]int),
+
+		tlsVersions:     make(map[string]int),
+		tlsCipherSuites: make(map[string]int),
+		alpnProtocols:   make(map[string]int),
+		connLats:        make([]float64, 0, cap),
+		dnsLats:         make([]float64, 0, cap),
+		reqLats:         make([]float64, 0, cap),
+		resLats:         make([]float64, 0, cap),
+		delayLats:       make([]float64, 0, cap),
+		lats:            make([]float64, 0, cap),
+		statusCodes:     make([]int, 0, cap),
+		connReused:      make([]bool, 0, cap),
 	}
 }
 
 func runReporter(r *report) {
+	// Abort conditions are also checked while no result comes in.
+	var tick <-chan time.Time
+	if len(r.abortConds) > 0 {
+		ticker := time.NewTicker(abortCheckInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 	// Loop will continue until channel is closed
-	for res := range r.results {
-		r.numRes++
+	for {
+		select {
+		case res, ok := <-r.results:
+			if !ok {
+				// Signal reporter is done.
+				r.done <- true
+				return
+			}
+			r.add(res)
+		case <-tick:
+			if r.abort == nil {
+				r.checkAbort()
+			}
+		}
+	}
+}
+
+// add adds res to the report.
+func (r *report) add(res *result) {
+	if res.iteration {
+		// The requests of the iteration are reported on their own.
 		if res.err != nil {
-			r.errorDist[res.err.Error()]++
-		} else {
-			r.avgTotal += res.duration.Seconds()
-			r.avgConn += res.connDuration.Seconds()
-			r.avgDelay += res.delayDuration.Seconds()
-			r.avgDNS += res.dnsDuration.Seconds()
-			r.avgReq += res.reqDuration.Seconds()
-			r.avgRes += res.resDuration.Seconds()
-			if len(r.resLats) < maxRes {
-				r.lats = append(r.lats, res.duration.Seconds())
-				r.connLats = append(r.connLats, res.connDuration.Seconds())
-				r.dnsLats = append(r.dnsLats, res.dnsDuration.Seconds())
-				r.reqLats = append(r.reqLats, res.reqDuration.Seconds())
-				r.delayLats = append(r.delayLats, res.delayDuration.Seconds())
-				r.resLats = append(r.resLats, res.resDuration.Seconds())
-				r.statusCodes = append(r.statusCodes, res.statusCode)
-				r.offsets = append(r.offsets, res.offset.Seconds())
+			key := errorKey(res.err)
+			r.iterationErrors[key]++
+			if msg := res.err.Error(); msg != key {
+				addErrorSample(r.iterationErrorSamples, key, msg)
+			}
+		} else if len(r.iterationLats) < maxRes {
+			r.iterationLats = append(r.iterationLats, res.duration.Seconds())
+		}
+		return
+	}
+	r.numRes++
+	if res.newConn {
+		r.connsOpened++
+	}
+	if res.proxyDuration > 0 && len(r.proxyLats) < maxRes {
+		r.proxyLats = append(r.proxyLats, res.proxyDuration.Seconds())
+	}
+	if res.scheduled && len(r.drifts) < maxRes {
+		r.drifts = append(r.drifts, res.drift.Seconds())
+	}
+	if st := res.tlsState; st != nil {
+		r.tlsHandshakes++
+		if st.DidResume {
+			r.tlsResumed++
+		}
+		r.tlsVersions[tlsVersionName(st.Version)]++
+		r.tlsCipherSuites[tls.CipherSuiteName(st.CipherSuite)]++
+		proto := st.NegotiatedProtocol
+		if proto == "" {
+			proto = "none"
+		}
+		r.alpnProtocols[proto]++
+		if len(r.tlsLats) < maxRes {
+			r.tlsLats = append(r.tlsLats, res.tlsDuration.Seconds())
+		}
+	}
+	if res.err != nil {
+		key := errorKey(res.err)
+		r.errorDist[key]++
+		addErrorSample(r.errorSamples, key, res.err.Error())
+		r.endpointErrors[res.endpoint]++
+	} else {
+		r.avgTotal += res.duration.Seconds()
+		r.avgConn += res.connDuration.Seconds()
+		r.avgDelay += res.delayDuration.Seconds()
+		r.avgDNS += res.dnsDuration.Seconds()
+		r.avgReq += res.reqDuration.Seconds()
+		r.avgRes += res.resDuration.Seconds()
+		if len(r.resLats) < maxRes {
+			r.lats = append(r.lats, res.duration.Seconds())
+			r.connLats = append(r.connLats, res.connDuration.Seconds())
+			r.dnsLats = append(r.dnsLats, res.dnsDuration.Seconds())
+			r.reqLats = append(r.reqLats, res.reqDuration.Seconds())
+			r.delayLats = append(r.delayLats, res.delayDuration.Seconds())
+			r.resLats = append(r.resLats, res.resDuration.Seconds())
+			r.statusCodes = append(r.statusCodes, res.statusCode)
+			r.offsets = append(r.offsets, res.offset.Seconds())
+			r.connReused = append(r.connReused, res.connReused)
+			r.endpoints = append(r.endpoints, res.endpoint)
+			if res.connWasIdle {
+				r.idleTimes = append(r.idleTimes, res.connIdleTime.Seconds())
 			}
-			if res.contentLength > 0 {
-				r.sizeTotal += res.contentLength
+		}
+		if res.contentLength > 0 {
+			r.sizeTotal += res.contentLength
+		}
+		if len(res.failed) > 0 {
+			r.failedRes++
+			for _, a := range res.failed {
+				r.assertionFailures[a]++
 			}
 		}
 	}
-	// Signal reporter is done.
-	r.done <- true
+	if len(r.abortConds) > 0 && r.abort == nil {
+		r.addAbortResult(res)
+	}
 }
 
 func (r *report) finalize(total time.Duration) ServerReport {
+	n := float64(len(r.lats))
+	if n == 0 {
+		// All requests failed, the averages are zero rather than NaN,
+		// which cannot be marshalled to JSON.
+		n = 1
+	}
 	return ServerReport{
 		TotalDuration: total,
-		AvgTotal:      r.avgTotal / float64(len(r.lats)),
+		AvgTotal:      r.avgTotal / n,
 		Rps:           float64(r.numRes) / total.Seconds(),
 		ContentLength: r.sizeTotal,
-		AvgConn:       r.avgConn / float64(len(r.lats)),
-		AvgDNS:        r.avgDNS / float64(len(r.lats)),
-		AvgReq:        r.avgReq / float64(len(r.lats)),
-		AvgRes:        r.avgRes / float64(len(r.lats)),
-		AvgDelay:      r.avgDelay / float64(len(r.lats)),
+		AvgConn:       r.avgConn / n,
+		AvgDNS:        r.avgDNS / n,
+		AvgReq:        r.avgReq / n,
+		AvgRes:        r.avgRes / n,
+		AvgDelay:      r.avgDelay / n,
 		Lats:          r.lats,
 		ConnLats:      r.connLats,
 		DnsLats:       r.dnsLats,
@@ -128,7 +259,28 @@ func (r *report) finalize(total time.Duration) ServerReport {
 		DelayLats:     r.delayLats,
 		Offsets:       r.offsets,
 		StatusCodes:   r.statusCodes,
+		ConnReused:    r.connReused,
+		IdleTimes:     r.idleTimes,
+		ConnsOpened:   r.connsOpened,
 		Errors:        r.errorDist,
+		ErrorSamples:  r.errorSamples,
+
+		ProxyLats:             r.proxyLats,
+		Drifts:                r.drifts,
+		Endpoints:             r.endpoints,
+		IterationLats:         r.iterationLats,
+		IterationErrors:       r.iterationErrors,
+		IterationErrorSamples: r.iterationErrorSamples,
+		TLSLats:               r.tlsLats,
+		TLSHandshakes:         r.tlsHandshakes,
+		TLSResumed:            r.tlsResumed,
+		TLSVersions:           r.tlsVersions,
+		TLSCipherSuites:       r.tlsCipherSuites,
+		ALPNProtocols:         r.alpnProtocols,
+
+		FailedResponses:   r.failedRes,
+		AssertionFailures: r.assertionFailures,
+		Abort:             r.abort,
 	}
 }
 
@@ -138,6 +290,14 @@ type Report struct {
 	Slowest  float64
 	Rps      float64
 
+	// AggregateRps is the rate of the servers of a distributed run
+	// together, where Rps is their average.
+	AggregateRps float64
+
+	// OfferedRate is the rate in requests per second the workers offered
+	// to the target, taking think time, pacing and QPS into account.
+	OfferedRate float64
+
 	AvgConn  float64
 	AvgDNS   float64
 	AvgReq   float64
@@ -154,27 +314,141 @@ type Report struct {
 	DelayMax float64
 	DelayMin float64
 
-	Lats        []float64
-	ConnLats    []float64
-	DnsLats     []float64
-	ReqLats     []float64
-	ResLats     []float64
-	DelayLats   []float64
-	Offsets     []float64
-	StatusCodes []int
+	// The latencies of each response are left out of JSON reports, the
+	// server reports carry them.
+	Lats        []float64 `json:"-"`
+	ConnLats    []float64 `json:"-"`
+	DnsLats     []float64 `json:"-"`
+	ReqLats     []float64 `json:"-"`
+	ResLats     []float64 `json:"-"`
+	DelayLats   []float64 `json:"-"`
+	Offsets     []float64 `json:"-"`
+	StatusCodes []int     `json:"-"`
+	ConnReused  []bool    `json:"-"`
 
 	Total time.Duration
 
+	// ConnsOpened is the number of connections opened over the run.
+	ConnsOpened int64
+	// NewConnRequests and ReusedConnRequests are the number of successful
+	// requests sent on a new and on a reused connection.
+	NewConnRequests    int64
+	ReusedConnRequests int64
+	// IdleTimeDistribution is the distribution of the time reused
+	// connections were idle in the pool before they were picked up.
+	IdleTimeDistribution []LatencyDistribution
+	// NewConnLatency and ReusedConnLatency are the request latencies on
+	// new and on reused connections.
+	NewConnLatency    LatencyStats
+	ReusedConnLatency LatencyStats
+	// ConnLoad is the load carried by the connections that served requests.
+	ConnLoad ConnLoad
+
+	// ProxyConnect is the time taken to open tunnels through the proxy,
+	// with CONNECT or SOCKS5.
+	ProxyConnect LatencyStats
+
+	// EndpointStats are the results of each endpoint, when requests were
+	// sent to more than one.
+	EndpointStats []EndpointStats
+
+	// StatusClassLatency is the latency of the responses grouped by the
+	// class of their status code, such as 2xx or 5xx.
+	StatusClassLatency []LatencyGroup
+
+	// ScheduleDrift is how late requests were sent compared to their
+	// Schedule, when replaying one.
+	ScheduleDrift LatencyStats
+
+	// Iterations is the duration of the scenario iterations that
+	// completed, think time excluded, and IterationErrors counts the
+	// failed iterations by error category, with a few distinct messages
+	// of each in IterationErrorSamples.
+	Iterations            LatencyStats
+	IterationErrors       map[string]int
+	IterationErrorSamples map[string][]string
+
+	// FailedResponses is the number of responses that failed at least one
+	// assertion, and AssertionFailures counts the failures by assertion.
+	// They are not part of ErrorDist.
+	FailedResponses   int64
+	AssertionFailures map[string]int
+
+	// Thresholds are the results of the thresholds checked against the
+	// report by CheckThresholds.
+	Thresholds []ThresholdResult
+
+	// Aborts are why and when the runs stopped early, one per server
+	// whose run was aborted.
+	Aborts []Abort
+
+	// TLSHandshakes is the number of TLS handshakes done over the run,
+	// TLSResumed how many of them resumed a previous session.
+	TLSHandshakes     int64
+	TLSResumed        int64
+	TLSResumptionRate float64
+	TLSHandshake      LatencyStats
+	// TLSVersions, TLSCipherSuites and ALPNProtocols count the handshakes
+	// by negotiated protocol version, cipher suite and ALPN protocol.
+	TLSVersions     map[string]int
+	TLSCipherSuites map[string]int
+	ALPNProtocols   map[string]int
+
 	ErrorDist      map[string]int
 	StatusCodeDist map[int]int
 	SizeTotal      int64
 	SizeReq        int64
 	NumRes         int64
 
+	// ErrorSamples are a few distinct messages of each error category of
+	// ErrorDist.
+	ErrorSamples map[string][]string
+
 	LatencyDistribution []LatencyDistribution
 	Histogram           []Bucket
 }
 
+// ConnLoad summarizes the requests carried by each connection. Streams
+// are the requests in flight on a connection at once, more than one only
+// with HTTP/2.
+type ConnLoad struct {
+	Conns          int
+	AvgRequests    float64
+	MaxRequests    int
+	AvgPeakStreams float64
+	MaxPeakStreams int
+}
+
+// EndpointStats are the results of the requests to one endpoint.
+type EndpointStats struct {
+	Name string
+	// Requests is the number of requests sent to the endpoint, Errors
+	// how many of them failed and Share their part of all requests.
+	Requests int64
+	Errors   int64
+	Share    float64
+	// Latency and Histogram are the latency of the successful requests.
+	Latency        LatencyStats
+	Histogram      []Bucket
+	StatusCodeDist map[int]int
+}
+
+// LatencyGroup is the latency of a group of responses.
+type LatencyGroup struct {
+	Name      string
+	Latency   LatencyStats
+	Histogram []Bucket
+}
+
+// LatencyStats summarizes a set of latencies, in seconds.
+type LatencyStats struct {
+	Count               int
+	Average             float64
+	Fastest             float64
+	Slowest             float64
+	LatencyDistribution []LatencyDistribution
+}
+
 type LatencyDistribution struct {
 	Percentage int
 	Latency    float64
@@ -17,34 +17,53 @@ package requester
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"golang.org/x/net/http2"
 )
 
 // Max size of the buffer of result channel.
 const maxResult = 1000000
 const maxIdleConn = 500
 
+// Max size of a response body read to extract values from.
+const maxBodyCapture = 10 << 20
+
 type result struct {
 	err           error
 	statusCode    int
 	offset        time.Duration
 	duration      time.Duration
 	connDuration  time.Duration // connection setup(DNS lookup + Dial up) duration
+	tlsDuration   time.Duration // TLS handshake duration
+	proxyDuration time.Duration // proxy CONNECT (or SOCKS) tunnel setup duration
 	dnsDuration   time.Duration // dns lookup duration
 	reqDuration   time.Duration // request "write" duration
 	resDuration   time.Duration // response "read" duration
 	delayDuration time.Duration // delay between response and request
 	contentLength int64
+	newConn       bool                 // request was sent on a newly opened connection
+	connReused    bool                 // request was sent on a reused connection
+	connWasIdle   bool                 // reused connection was idle in the pool
+	connIdleTime  time.Duration        // how long the reused connection was idle
+	tlsState      *tls.ConnectionState // negotiated state if a TLS handshake was done
+	endpoint      int                  // index of the endpoint in endpointNames
+	scheduled     bool                 // request was sent on a Schedule
+	drift         time.Duration        // how late the request was sent on its Schedule
+	iteration     bool                 // result of a scenario iteration, not of a request
+	failed        []string             // assertions the response failed
 }
 
 type Work struct {
@@ -53,6 +72,54 @@ type Work struct {
 
 	RequestBody []byte
 
+	// RequestBodies are the bodies of Requests, in the same order. If it
+	// is nil, RequestBody is sent with every request.
+	RequestBodies [][]byte
+
+	// Weights are the shares of Requests in the mix, in the same order.
+	// If it is nil, all requests have the same share.
+	Weights []float64
+
+	// Sample is an option to pick each request at random, in proportion
+	// to Weights, instead of cycling through Requests.
+	Sample bool
+
+	// Seed seeds the random picks of the workers, so that a run with the
+	// same Seed sends the same sequence of requests from each worker. If
+	// it is zero, a seed is taken from the clock.
+	Seed int64
+
+	// Template is an option to execute the URL, header values and body of
+	// Requests as text/template templates for each request, with a
+	// TemplateData. Templates are compiled by Init.
+	Template bool
+
+	// Data are the data files whose rows are fed to templates, in
+	// TemplateData.Data. The columns of all files are merged.
+	Data []*Feeder
+
+	// Steps make Requests a scenario: each worker makes all of them in
+	// order, as one iteration, and N is the number of iterations. Steps
+	// are in the same order as Requests, they extract values from the
+	// responses into variables that the templates of the next steps use
+	// as {{ .Vars.name }}. Weights, Sample and Schedule are ignored.
+	// Optional.
+	Steps []*Step
+
+	// Names are the names of the endpoints of Requests, in the same order,
+	// that results are broken down by. Requests with the same name are
+	// reported together. If it is nil, requests are named by their
+	// method and URL without the query.
+	Names []string
+
+	// Schedule is the time, relative to the start of the run, at which
+	// each of Requests is sent, in the same order. It must not decrease.
+	// If it is set, Requests are sent once each on the schedule instead of
+	// by closed-loop workers. N, QPS, ThinkTime, Pacing, Weights and
+	// Sample are then ignored and the C workers only bound the number of
+	// requests in flight. Optional.
+	Schedule []time.Duration
+
 	// RequestFunc is a function to generate requests. If it is nil, then
 	// Request and RequestData are cloned for each request.
 	RequestFunc func() *http.Request
@@ -66,12 +133,57 @@ type Work struct {
 	// H2 is an option to make HTTP/2 requests
 	H2 bool
 
+	// H2C is an option to make cleartext HTTP/2 requests with prior
+	// knowledge to http:// URLs. With an HTTP proxy, requests are tunneled
+	// through CONNECT.
+	H2C bool
+
+	// H2Conns is the number of HTTP/2 connections the workers are spread
+	// over, per host. If it is zero, the transport decides how many
+	// connections to open, usually one.
+	H2Conns int
+
+	// ConnPerWorker is an option to give each worker a transport of its
+	// own, so that workers behave like independent clients that each keep
+	// their own persistent connection.
+	ConnPerWorker bool
+
+	// MaxConnsPerHost limits the number of connections per host of a
+	// transport. Zero means no limit.
+	MaxConnsPerHost int
+
+	// MaxRequestsPerConn is the number of requests after which an HTTP/1
+	// connection is closed and replaced by a new one. Workers then get
+	// connections of their own, as with ConnPerWorker, so that each knows
+	// how many requests its connections carried. Zero means no limit.
+	MaxRequestsPerConn int
+
+	// H2MaxStreams is the maximum number of concurrent streams per
+	// HTTP/2 connection, used with H2Conns. Workers wait for a free stream
+	// once the limit is reached. Zero means no limit other than the
+	// server's.
+	H2MaxStreams int
+
 	// Timeout in seconds.
 	Timeout int
 
+	// Duration is the maximum duration of the run. If it is zero, the run
+	// lasts until N requests are made or Stop is called.
+	Duration time.Duration
+
 	// Qps is the rate limit in queries per second.
 	QPS float64
 
+	// ThinkTime is the pause each worker takes after a response before
+	// it starts its next request. Optional.
+	ThinkTime *ThinkTime
+
+	// Pacing is the interval at which each worker starts its requests,
+	// no matter how long the previous response took. If a request and
+	// its think time take longer than Pacing, the next request starts
+	// right away. Optional.
+	Pacing time.Duration
+
 	// DisableCompression is an option to disable compression in response
 	DisableCompression bool
 
@@ -81,21 +193,103 @@ type Work struct {
 	// DisableRedirects is an option to prevent the following of HTTP redirects
 	DisableRedirects bool
 
+	// TLSSessionResumption is an option to cache TLS sessions so that new
+	// connections can resume them instead of doing a full handshake.
+	TLSSessionResumption bool
+
+	// TLSVerify is an option to verify the server certificate chain and
+	// host name. Certificates are not verified by default.
+	TLSVerify bool
+
+	// RootCAs is the set of CAs used to verify server certificates with
+	// TLSVerify. If it is nil, the system roots are used.
+	RootCAs *x509.CertPool
+
+	// Certificates are the client certificates presented to servers that
+	// request them.
+	Certificates []tls.Certificate
+
+	// TLSServerName is the server name sent with SNI and verified against
+	// the server certificate. If it is empty, it is taken from the Host of
+	// the requests.
+	TLSServerName string
+
+	// TLSMinVersion and TLSMaxVersion bound the negotiated TLS version.
+	// Zero means the crypto/tls default.
+	TLSMinVersion uint16
+	TLSMaxVersion uint16
+
+	// TLSCipherSuites is the list of cipher suites offered for TLS 1.2 and
+	// earlier. If it is nil, the crypto/tls default is used.
+	TLSCipherSuites []uint16
+
 	// Output represents the output type. If "csv" is provided, the
 	// output will be dumped as a csv stream.
 	Output string
 
-	// ProxyAddr is the address of HTTP proxy server in the format on "host:port".
-	// Optional.
+	// UnixSocket is the path of a Unix domain socket all connections are
+	// made to, instead of the host of the request URLs. The Host header
+	// is still taken from the requests. Optional.
+	UnixSocket string
+
+	// Resolve pins host names to addresses, bypassing DNS. Keys are in the
+	// form "host:port" and values are IP addresses. Optional.
+	Resolve map[string]string
+
+	// DNSServer is the address in the form "host:port" of the DNS server
+	// to resolve host names with. If it is empty, the system resolver is
+	// used.
+	DNSServer string
+
+	// LocalAddrs are the local IP addresses connections are made from.
+	// Connections rotate through them, to spread the connections over
+	// more ephemeral ports than a single address has. Optional.
+	LocalAddrs []net.IP
+
+	// LocalAddrPerWorker is an option to bind each worker to one of
+	// LocalAddrs instead of rotating per connection. Each worker then
+	// gets a connection pool of its own, as with ConnPerWorker.
+	LocalAddrPerWorker bool
+
+	// Assertions are the checks of the responses. Optional.
+	Assertions []*Assertion
+
+	// AbortConditions stop the run early, as Stop does, when one of them
+	// holds over its window of the latest results. They are checked as
+	// results come in. Optional.
+	AbortConditions []*AbortCondition
+
+	// Cookies is an option to give each worker a cookie jar of its own,
+	// so that each worker keeps the session of a separate user over the
+	// run.
+	Cookies bool
+
+	// SeedCookies are the cookies the jar of each worker starts with,
+	// when Cookies is set. Optional.
+	SeedCookies []*SeedCookie
+
+	// ProxyAddr is the URL of the proxy server. The scheme is one of http,
+	// https or socks5, credentials in the URL are used to authenticate to
+	// the proxy. Optional.
 	ProxyAddr *url.URL
 
 	// Writer is where results will be written. If nil, results are written to stdout.
 	Writer io.Writer
 
-	initOnce sync.Once
-	results  chan *result
-	stopCh   chan struct{}
-	start    time.Duration
+	initOnce      sync.Once
+	stopOnce      sync.Once
+	conns         *connTracker
+	nextAddr      uint32
+	results       chan *result
+	stopCh        chan struct{}
+	start         time.Duration
+	endpoints     []int // index in endpointNames of each request
+	endpointNames []string
+	templates     []*requestTemplate
+	steps         []*Step // compiled copies of Steps
+	inflight      []int64 // start of the request of each worker in flight, with AbortConditions
+	seq           int64
+	initErr       error
 
 	report *report
 }
@@ -107,33 +301,122 @@ func (b *Work) writer() io.Writer {
 	return b.Writer
 }
 
-// Init initializes internal data-structures
-func (b *Work) Init() {
+// Init initializes internal data-structures and compiles the request
+// templates. It returns the error of a template that does not compile.
+func (b *Work) Init() error {
 	b.initOnce.Do(func() {
 		b.results = make(chan *result, min(b.C*1000, maxResult))
-		b.stopCh = make(chan struct{}, b.C)
+		b.stopCh = make(chan struct{})
+		b.conns = newConnTracker()
+		b.initEndpoints()
+		if b.Steps != nil && len(b.Steps) != len(b.Requests) {
+			b.initErr = fmt.Errorf("%d steps for %d requests", len(b.Steps), len(b.Requests))
+			return
+		}
+		// Steps may be shared with concurrent runs, they are compiled
+		// into copies of this run.
+		for _, s := range b.Steps {
+			var step *Step
+			if step, b.initErr = s.compile(); b.initErr != nil {
+				return
+			}
+			b.steps = append(b.steps, step)
+		}
+		if b.Template || b.Steps != nil {
+			b.initErr = b.initTemplates()
+		}
 	})
+	return b.initErr
+}
+
+func (b *Work) initTemplates() error {
+	b.templates = make([]*requestTemplate, len(b.Requests))
+	for i, req := range b.Requests {
+		t, err := compileTemplate(req, b.requestBody(i))
+		if err != nil {
+			return err
+		}
+		if t.url != nil || t.header != nil || t.body != nil {
+			b.templates[i] = t
+		}
+	}
+	return nil
+}
+
+// initEndpoints groups Requests by name.
+func (b *Work) initEndpoints() {
+	b.endpoints = make([]int, len(b.Requests))
+	index := make(map[string]int)
+	for i, req := range b.Requests {
+		var name string
+		if i < len(b.Names) && b.Names[i] != "" {
+			name = b.Names[i]
+		} else {
+			u := *req.URL
+			u.RawQuery, u.Fragment = "", ""
+			name = req.Method + " " + u.String()
+		}
+		j, ok := index[name]
+		if !ok {
+			j = len(b.endpointNames)
+			index[name] = j
+			b.endpointNames = append(b.endpointNames, name)
+		}
+		b.endpoints[i] = j
+	}
 }
 
 // Run makes all the requests, prints the summary. It blocks until
 // all work is done.
 func (b *Work) Run() ServerReport {
-	b.Init()
+	return b.RunContext(context.Background())
+}
+
+// RunContext is like Run but stops the workers and cancels in-flight
+// requests when ctx is done, Duration elapses or Stop is called.
+func (b *Work) RunContext(ctx context.Context) ServerReport {
+	if err := b.Init(); err != nil {
+		return ServerReport{Errors: map[string]int{err.Error(): 1}}
+	}
+	var cancel context.CancelFunc
+	if b.Duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, b.Duration)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	go func() {
+		select {
+		case <-b.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	b.start = now()
 	b.report = newReport(b.writer(), b.results, b.Output, b.N)
+	if len(b.AbortConditions) > 0 {
+		b.inflight = make([]int64, b.C)
+	}
+	b.report.abortConds, b.report.start, b.report.stop = b.AbortConditions, b.start, b.Stop
+	b.report.inflight = b.inflight
+	// The first check waits for abortCheckInterval of results.
+	b.report.lastCheck = b.start
 	// Run the reporter first, it polls the result channel until it is closed.
 	go func() {
 		runReporter(b.report)
 	}()
-	b.runWorkers()
+	b.runWorkers(ctx)
 	return b.Finish()
 }
 
+// Stop stops the workers and cancels their in-flight requests. It is safe
+// to call Stop more than once and from multiple goroutines.
 func (b *Work) Stop() {
-	// Send stop signal so that workers can stop gracefully.
-	for i := 0; i < b.C; i++ {
-		b.stopCh <- struct{}{}
-	}
+	b.Init()
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+	})
 }
 
 func (b *Work) Finish() ServerReport {
@@ -141,57 +424,240 @@ func (b *Work) Finish() ServerReport {
 	total := now() - b.start
 	// Wait until the reporter is done.
 	<-b.report.done
-	return b.report.finalize(total)
+	rep := b.report.finalize(total)
+	rep.OfferedRate = b.offeredRate(rep.AvgTotal)
+	rep.ConnRequests, rep.ConnPeakStreams = b.conns.load()
+	if len(b.endpointNames) > 1 && b.RequestFunc == nil {
+		rep.EndpointNames = b.endpointNames
+		rep.EndpointErrors = make([]int, len(b.endpointNames))
+		for i, n := range b.report.endpointErrors {
+			rep.EndpointErrors[i] = n
+		}
+	} else {
+		rep.Endpoints = nil
+	}
+	return rep
+}
+
+// offeredRate returns the rate in requests per second the workers offer
+// to the target, given the average request latency in seconds. Each
+// worker starts a request once per the longest of the pacing interval,
+// the QPS interval and the latency plus the mean think time. On a
+// Schedule, the offered rate is the rate of the schedule.
+func (b *Work) offeredRate(avgLatency float64) float64 {
+	if n := len(b.Schedule); n > 0 {
+		if last := b.Schedule[n-1].Seconds(); last > 0 {
+			return float64(n) / last
+		}
+		return 0
+	}
+	interval := avgLatency
+	if b.ThinkTime != nil {
+		interval += b.ThinkTime.mean().Seconds()
+	}
+	if p := b.Pacing.Seconds(); p > interval {
+		interval = p
+	}
+	if b.QPS > 0 && 1/b.QPS > interval {
+		interval = 1 / b.QPS
+	}
+	if interval <= 0 {
+		return 0
+	}
+	return float64(b.C) / interval
+}
+
+// requestBody returns the body of the i-th request.
+func (b *Work) requestBody(i int) []byte {
+	if b.RequestBodies != nil {
+		return b.RequestBodies[i]
+	}
+	return b.RequestBody
 }
 
-func (b *Work) makeRequest(c *http.Client, i int) {
+// newRequest returns the i-th request to send from worker w, with its
+// templates executed.
+func (b *Work) newRequest(i int, w *worker) (*http.Request, error) {
+	body := b.requestBody(i)
+	if b.templates == nil || b.templates[i] == nil {
+		return cloneRequest(b.Requests[i], body), nil
+	}
+	data := &TemplateData{
+		Seq:    atomic.AddInt64(&b.seq, 1) - 1,
+		Worker: w.id,
+		Now:    time.Now(),
+		Vars:   w.vars,
+		rnd:    w.rnd,
+	}
+	for j, f := range b.Data {
+		row := f.row(w, j, b.C)
+		if len(b.Data) == 1 {
+			data.Data = row
+			break
+		}
+		if data.Data == nil {
+			data.Data = make(map[string]string)
+		}
+		for k, v := range row {
+			data.Data[k] = v
+		}
+	}
+	req := cloneRequest(b.Requests[i], nil)
+	tbody, err := b.templates[i].execute(req, data)
+	if err != nil {
+		return nil, err
+	}
+	if tbody != nil {
+		body = tbody
+		req.ContentLength = int64(len(body))
+	}
+	if len(body) > 0 {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return req, nil
+}
+
+// makeRequest makes the i-th request from worker w and reports its result.
+// It returns the error of the request, or of the extraction of the values
+// of its step.
+func (b *Work) makeRequest(ctx context.Context, c *http.Client, i int, w *worker) error {
 	s := now()
 	var size int64
 	var code int
-	var dnsStart, connStart, resStart, reqStart, delayStart time.Duration
-	var dnsDuration, connDuration, resDuration, reqDuration, delayDuration time.Duration
+	var dnsStart, connStart, tlsStart, resStart, reqStart, delayStart time.Duration
+	var dnsDuration, connDuration, tlsDuration, resDuration, reqDuration, delayDuration time.Duration
+	var connInfo httptrace.GotConnInfo
+	var gotConn bool
+	var tlsState *tls.ConnectionState
+	var proxyNanos int64
+	// The transport dials on a goroutine of its own and may hand the
+	// connection to another request, and HTTP/2 writes the request and
+	// reads the response on different goroutines, so the hooks may run
+	// concurrently with each other and with the end of the request.
+	var mu sync.Mutex
 	var req *http.Request
 	if b.RequestFunc != nil {
 		req = b.RequestFunc()
 	} else {
-		req = cloneRequest(b.Requests[i%len(b.Requests)], b.RequestBody)
+		var err error
+		if req, err = b.newRequest(i, w); err != nil {
+			b.results <- &result{offset: s, err: err, endpoint: b.endpoints[i]}
+			return err
+		}
 	}
 	trace := &httptrace.ClientTrace{
 		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
 			dnsStart = now()
 		},
 		DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
 			dnsDuration = now() - dnsStart
 		},
 		GetConn: func(h string) {
+			mu.Lock()
+			defer mu.Unlock()
 			connStart = now()
 		},
-		GotConn: func(connInfo httptrace.GotConnInfo) {
-			if !connInfo.Reused {
-				connDuration = now() - connStart
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsDuration = now() - tlsStart
+			if err == nil {
+				tlsState = &state
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !info.Reused {
+				// The proxy tunnel and the TLS handshake are reported as
+				// phases of their own.
+				connDuration = now() - connStart - tlsDuration - time.Duration(atomic.LoadInt64(&proxyNanos))
 			}
+			connInfo, gotConn = info, true
+			b.conns.acquire(info.Conn)
 			reqStart = now()
 		},
 		WroteRequest: func(w httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
 			reqDuration = now() - reqStart
 			delayStart = now()
 		},
 		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
 			delayDuration = now() - delayStart
 			resStart = now()
 		},
 	}
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	ctx = context.WithValue(ctx, proxyTimingKey{}, &proxyNanos)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	key := b.connKey(req)
+	if b.MaxRequestsPerConn > 0 && w.connRequests[key]+1 >= b.MaxRequestsPerConn {
+		// The connection reaches its limit with this request, the
+		// transport closes it after the response and dials a new one for
+		// the next request.
+		req.Close = true
+	}
+	var r *response
+	var failed []string
+	if b.inflight != nil {
+		atomic.StoreInt64(&b.inflight[w.id], int64(s))
+	}
 	resp, err := c.Do(req)
 	if err == nil {
 		size = resp.ContentLength
 		code = resp.StatusCode
-		io.Copy(ioutil.Discard, resp.Body)
+		r = &response{resp: resp}
+		if b.needsBody(i) {
+			r.body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxBodyCapture))
+		}
+		n, _ := io.Copy(ioutil.Discard, resp.Body)
+		r.size = int64(len(r.body)) + n
 		resp.Body.Close()
+		failed = b.checkAssertions(r)
+	}
+	if b.inflight != nil {
+		atomic.StoreInt64(&b.inflight[w.id], 0)
+	}
+	if gotConn {
+		b.conns.release(connInfo.Conn)
+		switch {
+		case req.Close:
+			delete(w.connRequests, key)
+		case connInfo.Reused:
+			w.connRequests[key]++
+		default:
+			w.connRequests[key] = 1
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		// The run was stopped while the request was in flight, it is not
+		// a failure of the target.
+		return err
 	}
 	t := now()
+	mu.Lock()
+	defer mu.Unlock()
 	resDuration = t - resStart
 	finish := t - s
+	var endpoint int
+	if b.RequestFunc == nil {
+		endpoint = b.endpoints[i]
+	}
+	var drift time.Duration
+	if b.Schedule != nil {
+		drift = s - b.start - b.Schedule[i]
+	}
 	b.results <- &result{
 		offset:        s,
 		statusCode:    code,
@@ -199,67 +665,274 @@ func (b *Work) makeRequest(c *http.Client, i int) {
 		err:           err,
 		contentLength: size,
 		connDuration:  connDuration,
+		tlsDuration:   tlsDuration,
+		proxyDuration: time.Duration(atomic.LoadInt64(&proxyNanos)),
 		dnsDuration:   dnsDuration,
 		reqDuration:   reqDuration,
 		resDuration:   resDuration,
 		delayDuration: delayDuration,
+		newConn:       gotConn && !connInfo.Reused,
+		connReused:    connInfo.Reused,
+		connWasIdle:   connInfo.WasIdle,
+		connIdleTime:  connInfo.IdleTime,
+		tlsState:      tlsState,
+		endpoint:      endpoint,
+		scheduled:     b.Schedule != nil,
+		drift:         drift,
+		failed:        failed,
 	}
+	if err == nil && b.Steps != nil {
+		if len(failed) > 0 {
+			return &stepError{fmt.Sprintf("assertion %s failed", failed[0])}
+		}
+		return b.steps[i].extract(r, w.vars)
+	}
+	return err
 }
 
-func (b *Work) runWorker(client *http.Client, n int) {
-	var throttle <-chan time.Time
-	if b.QPS > 0 {
-		throttle = time.Tick(time.Duration(1e6/(b.QPS)) * time.Microsecond)
+// needsBody reports whether the body of the response to the i-th request
+// is checked or has values extracted from.
+func (b *Work) needsBody(i int) bool {
+	if b.Steps != nil && b.steps[i].needsBody() {
+		return true
 	}
+	for _, a := range b.Assertions {
+		if a.needsBody() {
+			return true
+		}
+	}
+	return false
+}
 
-	if b.DisableRedirects {
-		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
+// send makes the i-th request from worker w once a stream of streams, if
+// any, is free. It returns the error of makeRequest, or the error of ctx
+// if the run was stopped.
+func (b *Work) send(ctx context.Context, c *http.Client, streams chan struct{}, i int, w *worker) error {
+	if streams != nil {
+		// Wait for a free stream on the worker's HTTP/2 connection.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case streams <- struct{}{}:
 		}
+		defer func() { <-streams }()
+	}
+	return b.makeRequest(ctx, c, i, w)
+}
+
+func (b *Work) runWorker(ctx context.Context, client *http.Client, streams chan struct{}, n int, w *worker) {
+	var throttle <-chan time.Time
+	if b.QPS > 0 {
+		ticker := time.NewTicker(time.Duration(1e6/(b.QPS)) * time.Microsecond)
+		defer ticker.Stop()
+		throttle = ticker.C
 	}
+
+	p := b.newPicker(w.rnd)
 	for i := 0; i < n; i++ {
 		// Check if application is stopped. Do not send into a closed channel.
 		select {
-		case <-b.stopCh:
+		case <-ctx.Done():
 			return
 		default:
-			if b.QPS > 0 {
-				<-throttle
+		}
+		if b.QPS > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-throttle:
 			}
-			b.makeRequest(client, i)
+		}
+		start := now()
+		if b.Steps != nil {
+			b.runIteration(ctx, client, streams, w)
+		} else {
+			b.send(ctx, client, streams, p.next(), w)
+		}
+		if i == n-1 {
+			return
+		}
+		if b.ThinkTime != nil && !sleep(ctx, b.ThinkTime.next(w.rnd)) {
+			return
+		}
+		if b.Pacing > 0 && !sleep(ctx, b.Pacing-(now()-start)) {
+			return
 		}
 	}
 }
 
-func (b *Work) runWorkers() {
+func (b *Work) runWorkers(ctx context.Context) {
+	// Workers share one client, unless several HTTP/2 connections or
+	// connections of their own for the workers are asked for. Then each
+	// connection or worker gets a client of its own and the workers are
+	// spread over them.
+	clients := []*http.Client{b.client(b.transport())}
+	if (b.H2 || b.H2C) && b.H2Conns > 0 {
+		clients = make([]*http.Client, b.H2Conns)
+		for i := range clients {
+			clients[i] = b.client(b.h2Transport())
+		}
+	} else if b.ConnPerWorker || b.MaxRequestsPerConn > 0 || (b.LocalAddrPerWorker && len(b.LocalAddrs) > 0) {
+		clients = make([]*http.Client, b.C)
+		for i := range clients {
+			clients[i] = b.client(b.transport())
+		}
+	}
+	streams := make([]chan struct{}, len(clients))
+	if (b.H2 || b.H2C) && b.H2Conns > 0 && b.H2MaxStreams > 0 {
+		for i := range streams {
+			streams[i] = make(chan struct{}, b.H2MaxStreams)
+		}
+	}
+
+	if b.Schedule != nil {
+		b.runSchedule(ctx, clients, streams)
+		return
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(b.C)
+	seed := b.seed()
+	for i := 0; i < b.C; i++ {
+		go func(ctx context.Context, client *http.Client, streams chan struct{}, n int, w *worker) {
+			b.runWorker(ctx, client, streams, n, w)
+			wg.Done()
+		}(b.workerContext(ctx, i), b.workerClient(clients[i%len(clients)]), streams[i%len(streams)], workerN(b.N, b.C, i), b.newWorker(i, seed))
+	}
+	wg.Wait()
+}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         b.Requests[0].Host,
-		},
-		MaxIdleConnsPerHost: min(b.C, maxIdleConn),
-		DisableCompression:  b.DisableCompression,
-		DisableKeepAlives:   b.DisableKeepAlives,
-		Proxy:               http.ProxyURL(b.ProxyAddr),
+// runSchedule sends each request at its time in Schedule. Due requests
+// are handed to the first free of the C workers, so a request is sent
+// late when all of them are busy.
+func (b *Work) runSchedule(ctx context.Context, clients []*http.Client, streams []chan struct{}) {
+	var wg sync.WaitGroup
+	wg.Add(b.C)
+	due := make(chan int)
+	seed := b.seed()
+	for i := 0; i < b.C; i++ {
+		go func(ctx context.Context, client *http.Client, streams chan struct{}, w *worker) {
+			defer wg.Done()
+			for j := range due {
+				b.send(ctx, client, streams, j, w)
+			}
+		}(b.workerContext(ctx, i), b.workerClient(clients[i%len(clients)]), streams[i%len(streams)], b.newWorker(i, seed))
+	}
+
+loop:
+	for j, at := range b.Schedule {
+		if !sleep(ctx, at-(now()-b.start)) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case due <- j:
+		}
+	}
+	close(due)
+	wg.Wait()
+}
+
+// seed returns the seed of the workers' random sources, Seed or else a
+// seed of its own for each run.
+func (b *Work) seed() int64 {
+	if b.Seed != 0 {
+		return b.Seed
+	}
+	return time.Now().UnixNano()
+}
+
+// newWorker returns the state of the i-th worker of a run seeded with seed.
+func (b *Work) newWorker(i int, seed int64) *worker {
+	return &worker{
+		id:           i,
+		rnd:          rand.New(rand.NewSource(seed + int64(i))),
+		uses:         make([]int, len(b.Data)),
+		connRequests: make(map[string]int),
+	}
+}
+
+// workerContext returns the context of the i-th worker.
+func (b *Work) workerContext(ctx context.Context, i int) context.Context {
+	if b.LocalAddrPerWorker && len(b.LocalAddrs) > 0 {
+		return context.WithValue(ctx, localAddrKey{}, b.LocalAddrs[i%len(b.LocalAddrs)])
 	}
-	if b.H2 {
-		http2.ConfigureTransport(tr)
+	return ctx
+}
+
+// workerN returns the number of requests the i-th of c workers should
+// make so that all workers together make exactly n requests. The
+// remainder of n/c is spread over the first n%c workers.
+func workerN(n, c, i int) int {
+	if i < n%c {
+		return n/c + 1
+	}
+	return n / c
+}
+
+// picker picks the requests a worker makes. Without weights, it cycles
+// through the requests in order. With weights, it cycles through them
+// with smooth weighted round-robin, so that the shares are kept over any
+// stretch of requests, or it samples them at random if Sample is set.
+type picker struct {
+	weights  []float64
+	weighted bool // not all weights are equal
+	total    float64
+	current  []float64
+	sample   bool
+	rnd      *rand.Rand
+	i        int
+}
+
+func (b *Work) newPicker(rnd *rand.Rand) *picker {
+	p := &picker{sample: b.Sample, rnd: rnd}
+	if len(b.Weights) == len(b.Requests) {
+		p.weights = b.Weights
 	} else {
-		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		p.weights = make([]float64, len(b.Requests))
+		for i := range p.weights {
+			p.weights[i] = 1
+		}
+	}
+	for _, w := range p.weights {
+		p.total += w
+		p.weighted = p.weighted || w != p.weights[0]
 	}
-	client := &http.Client{Transport: tr, Timeout: time.Duration(b.Timeout) * time.Second}
+	p.current = make([]float64, len(p.weights))
+	return p
+}
 
-	// Ignore the case where b.N % b.C != 0.
-	for i := 0; i < b.C; i++ {
-		go func() {
-			b.runWorker(client, b.N/b.C)
-			wg.Done()
-		}()
+// next returns the index in Requests of the next request.
+func (p *picker) next() int {
+	if len(p.weights) == 0 {
+		// Requests come from RequestFunc.
+		return 0
 	}
-	wg.Wait()
+	if p.sample {
+		x := p.rnd.Float64() * p.total
+		for i, w := range p.weights {
+			if x < w {
+				return i
+			}
+			x -= w
+		}
+		return len(p.weights) - 1
+	}
+	if p.weighted {
+		best := 0
+		for i, w := range p.weights {
+			p.current[i] += w
+			if p.current[i] > p.current[best] {
+				best = i
+			}
+		}
+		p.current[best] -= p.total
+		return best
+	}
+	i := p.i % len(p.weights)
+	p.i++
+	return i
 }
 
 // cloneRequest returns a clone of the provided *http.Request.
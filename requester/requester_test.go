@@ -16,13 +16,41 @@ package requester
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestN(t *testing.T) {
@@ -35,9 +63,9 @@ func TestN(t *testing.T) {
 
 	req, _ := http.NewRequest("GET", server.URL, nil)
 	w := &Work{
-		Request: req,
-		N:       20,
-		C:       2,
+		Requests: []*http.Request{req},
+		N:        20,
+		C:        2,
 	}
 	w.Run()
 	if count != 20 {
@@ -45,6 +73,35 @@ func TestN(t *testing.T) {
 	}
 }
 
+func TestNRemainder(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, int64(1))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	for _, tc := range []struct{ n, c int }{
+		{1, 1}, {7, 3}, {10, 4}, {23, 5}, {99, 10}, {100, 7},
+	} {
+		atomic.StoreInt64(&count, 0)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		w := &Work{
+			Requests: []*http.Request{req},
+			N:        tc.n,
+			C:        tc.c,
+			Writer:   ioutil.Discard,
+		}
+		rep := w.Run()
+		if got := atomic.LoadInt64(&count); got != int64(tc.n) {
+			t.Errorf("n=%d c=%d: expected to send %d requests, found %v", tc.n, tc.c, tc.n, got)
+		}
+		if got := len(rep.Lats); got != tc.n {
+			t.Errorf("n=%d c=%d: expected %d reported results, found %v", tc.n, tc.c, tc.n, got)
+		}
+	}
+}
+
 func TestQps(t *testing.T) {
 	var wg sync.WaitGroup
 	var count int64
@@ -56,10 +113,10 @@ func TestQps(t *testing.T) {
 
 	req, _ := http.NewRequest("GET", server.URL, nil)
 	w := &Work{
-		Request: req,
-		N:       20,
-		C:       2,
-		QPS:     1,
+		Requests: []*http.Request{req},
+		N:        20,
+		C:        2,
+		QPS:      1,
 	}
 	wg.Add(1)
 	time.AfterFunc(time.Second, func() {
@@ -90,9 +147,9 @@ func TestRequest(t *testing.T) {
 	req.Header = header
 	req.SetBasicAuth("username", "password")
 	w := &Work{
-		Request: req,
-		N:       1,
-		C:       1,
+		Requests: []*http.Request{req},
+		N:        1,
+		C:        1,
 	}
 	w.Run()
 	if uri != "/" {
@@ -122,7 +179,7 @@ func TestBody(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", server.URL, bytes.NewBuffer([]byte("Body")))
 	w := &Work{
-		Request:     req,
+		Requests:    []*http.Request{req},
 		RequestBody: []byte("Body"),
 		N:           10,
 		C:           1,
@@ -132,3 +189,1912 @@ func TestBody(t *testing.T) {
 		t.Errorf("Expected to work 10 times, found %v", count)
 	}
 }
+
+func TestDuration(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        1000000,
+		C:        2,
+		Duration: 100 * time.Millisecond,
+		Writer:   ioutil.Discard,
+	}
+	start := time.Now()
+	w.Run()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Expected to stop after about 100ms, took %v", d)
+	}
+}
+
+func TestStopInFlight(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	defer close(release)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        10,
+		C:        2,
+		Timeout:  30,
+		Writer:   ioutil.Discard,
+	}
+	time.AfterFunc(100*time.Millisecond, w.Stop)
+	done := make(chan ServerReport)
+	go func() {
+		done <- w.Run()
+	}()
+	select {
+	case rep := <-done:
+		if len(rep.Errors) > 0 {
+			t.Errorf("Expected cancelled requests not to be reported as errors, found %v", rep.Errors)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Stop to cancel in-flight requests")
+	}
+
+	// Stopping again, concurrently or after the run, must not block.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			w.Stop()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRunContext(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        10,
+		C:        2,
+		Writer:   ioutil.Discard,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	w.RunContext(ctx)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected to stop when the context is done, took %v", d)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, int64(1))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        4,
+		C:        1,
+		Pacing:   100 * time.Millisecond,
+		Writer:   ioutil.Discard,
+	}
+	start := time.Now()
+	rep := w.Run()
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("Expected 4 paced requests to take at least 300ms, took %v", d)
+	}
+	if count != 4 {
+		t.Errorf("Expected to send 4 requests, found %v", count)
+	}
+	if rep.OfferedRate < 9 || rep.OfferedRate > 10.01 {
+		t.Errorf("Expected an offered rate of about 10 requests/sec, found %v", rep.OfferedRate)
+	}
+}
+
+func TestParseThinkTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ThinkTime
+	}{
+		{"200ms", ThinkTime{Distribution: ThinkFixed, Mean: 200 * time.Millisecond}},
+		{"fixed:1s", ThinkTime{Distribution: ThinkFixed, Mean: time.Second}},
+		{"uniform:100ms-500ms", ThinkTime{Distribution: ThinkUniform, Min: 100 * time.Millisecond, Max: 500 * time.Millisecond}},
+		{"normal:300ms,50ms", ThinkTime{Distribution: ThinkNormal, Mean: 300 * time.Millisecond, StdDev: 50 * time.Millisecond}},
+		{"exp:200ms", ThinkTime{Distribution: ThinkExponential, Mean: 200 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		got, err := ParseThinkTime(tt.in)
+		if err != nil {
+			t.Errorf("ParseThinkTime(%q) errored: %v", tt.in, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("ParseThinkTime(%q) = %+v; want %+v", tt.in, *got, tt.want)
+		}
+	}
+	for _, in := range []string{"", "poisson:1s", "uniform:500ms-100ms", "normal:300ms", "-1s", "fixed:-200ms", "exponential:-1s"} {
+		if _, err := ParseThinkTime(in); err == nil {
+			t.Errorf("ParseThinkTime(%q) expected to error", in)
+		}
+	}
+}
+
+func TestConnReuse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        10,
+		C:        1,
+		Writer:   ioutil.Discard,
+	}
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if rep.ConnsOpened != 1 {
+		t.Errorf("Expected to open 1 connection, found %v", rep.ConnsOpened)
+	}
+	if rep.NewConnRequests != 1 || rep.ReusedConnRequests != 9 {
+		t.Errorf("Expected 1 new and 9 reused connection requests, found %v and %v", rep.NewConnRequests, rep.ReusedConnRequests)
+	}
+	if rep.ReusedConnLatency.Count != 9 {
+		t.Errorf("Expected 9 reused connection latencies, found %v", rep.ReusedConnLatency.Count)
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests:             []*http.Request{req},
+		N:                    5,
+		C:                    1,
+		DisableKeepAlives:    true,
+		TLSSessionResumption: true,
+		Writer:               ioutil.Discard,
+	}
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if rep.TLSHandshakes != 5 {
+		t.Errorf("Expected 5 TLS handshakes, found %v", rep.TLSHandshakes)
+	}
+	if rep.TLSHandshake.Count != 5 || rep.TLSHandshake.Fastest <= 0 {
+		t.Errorf("Expected 5 TLS handshake latencies, found %+v", rep.TLSHandshake)
+	}
+	if rep.TLSVersions["TLS 1.3"] != 5 {
+		t.Errorf("Expected TLS 1.3 to be negotiated, found %v", rep.TLSVersions)
+	}
+	if rep.TLSResumed == 0 {
+		t.Errorf("Expected TLS sessions to be resumed")
+	}
+}
+
+// testCert returns a certificate for 127.0.0.1 signed by parent, or a
+// self-signed CA certificate if parent is nil.
+func testCert(t *testing.T, parent *tls.Certificate, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "hey test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientTLS(t *testing.T) {
+	ca := testCert(t, nil, 1)
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rootCAs, err := LoadCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clientCerts int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			atomic.AddInt64(&clientCerts, 1)
+		}
+	}))
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, &ca, 2)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    rootCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	run := func(w *Work) ServerReport {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		w.Requests = []*http.Request{req}
+		w.N = 4
+		w.C = 2
+		w.Writer = ioutil.Discard
+		return w.Run()
+	}
+
+	rep := run(&Work{
+		TLSVerify:     true,
+		RootCAs:       rootCAs,
+		Certificates:  []tls.Certificate{testCert(t, &ca, 3)},
+		TLSMaxVersion: tls.VersionTLS12,
+		TLSCipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		},
+	})
+	if len(rep.Errors) > 0 {
+		t.Errorf("Expected no errors with a client certificate, found %v", rep.Errors)
+	}
+	if clientCerts != 4 {
+		t.Errorf("Expected 4 requests with a client certificate, found %v", clientCerts)
+	}
+	if rep.TLSVersions["TLS 1.2"] == 0 || rep.TLSCipherSuites["TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"] == 0 {
+		t.Errorf("Expected the pinned version and cipher suite, found %v and %v", rep.TLSVersions, rep.TLSCipherSuites)
+	}
+
+	rep = run(&Work{TLSVerify: true, RootCAs: rootCAs})
+	if len(rep.Lats) > 0 || len(rep.Errors) == 0 {
+		t.Errorf("Expected requests without a client certificate to fail, found %d successes", len(rep.Lats))
+	}
+
+	rep = run(&Work{TLSVerify: true, Certificates: []tls.Certificate{testCert(t, &ca, 4)}})
+	if len(rep.Lats) > 0 || len(rep.Errors) == 0 {
+		t.Errorf("Expected requests to fail verification against the system roots, found %d successes", len(rep.Lats))
+	}
+
+	rep = run(&Work{TLSVerify: true, RootCAs: rootCAs, Certificates: []tls.Certificate{testCert(t, &ca, 5)}, TLSServerName: "example.com"})
+	if len(rep.Lats) > 0 || len(rep.Errors) == 0 {
+		t.Errorf("Expected requests to fail verification of a wrong server name, found %d successes", len(rep.Lats))
+	}
+}
+
+func TestParseTLSOptions(t *testing.T) {
+	if v, err := ParseTLSVersion("1.2"); err != nil || v != tls.VersionTLS12 {
+		t.Errorf("ParseTLSVersion(1.2) = %v, %v; want %v", v, err, tls.VersionTLS12)
+	}
+	if _, err := ParseTLSVersion("2.0"); err == nil {
+		t.Errorf("ParseTLSVersion(2.0) expected to error")
+	}
+	suites, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil || len(suites) != 2 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("ParseCipherSuites = %v, %v", suites, err)
+	}
+	if _, err := ParseCipherSuites("TLS_NOPE"); err == nil {
+		t.Errorf("ParseCipherSuites(TLS_NOPE) expected to error")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	var h2 int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.AddInt64(&h2, 1)
+		}
+		w.Write([]byte("ok"))
+	}
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handler), &http2.Server{}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        10,
+		C:        2,
+		H2C:      true,
+		Writer:   ioutil.Discard,
+	}
+	rep := w.Run()
+	if len(rep.Errors) > 0 {
+		t.Errorf("Expected no errors, found %v", rep.Errors)
+	}
+	if h2 != 10 {
+		t.Errorf("Expected 10 HTTP/2 requests, found %v", h2)
+	}
+}
+
+func TestH2ConnsAndStreams(t *testing.T) {
+	var mu sync.Mutex
+	active := make(map[string]int)
+	peak := make(map[string]int)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active[r.RemoteAddr]++
+		if active[r.RemoteAddr] > peak[r.RemoteAddr] {
+			peak[r.RemoteAddr] = active[r.RemoteAddr]
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active[r.RemoteAddr]--
+		mu.Unlock()
+		w.Write([]byte("ok"))
+	}
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handler), &http2.Server{}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests:     []*http.Request{req},
+		N:            48,
+		C:            12,
+		H2C:          true,
+		H2Conns:      3,
+		H2MaxStreams: 2,
+		Writer:       ioutil.Discard,
+	}
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if len(peak) != 3 {
+		t.Errorf("Expected 3 connections, found %v", len(peak))
+	}
+	for addr, p := range peak {
+		if p > 2 {
+			t.Errorf("Expected at most 2 concurrent streams on %v, found %v", addr, p)
+		}
+	}
+	if rep.ConnLoad.Conns != 3 || rep.ConnLoad.MaxPeakStreams > 2 {
+		t.Errorf("Expected 3 connections with at most 2 streams in the report, found %+v", rep.ConnLoad)
+	}
+}
+
+func TestH2ConnsDial(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{Requests: []*http.Request{req}, N: 10, C: 4, H2: true, H2Conns: 2, Writer: ioutil.Discard}
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if len(rep.ErrorDist) > 0 {
+		t.Fatalf("Expected no errors, found %v", rep.ErrorDist)
+	}
+	if rep.TLSHandshakes != 2 || rep.TLSHandshake.Fastest <= 0 {
+		t.Errorf("Expected the 2 TLS handshakes to be timed, found %v: %+v", rep.TLSHandshakes, rep.TLSHandshake)
+	}
+
+	// A server that never answers the handshake does not hang the run.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, c)
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	req, _ = http.NewRequest("GET", "https://"+ln.Addr().String(), nil)
+	w = &Work{Requests: []*http.Request{req}, N: 2, C: 1, H2: true, H2Conns: 1, Timeout: 1, Writer: ioutil.Discard}
+	start := time.Now()
+	rep = GenClientReport([]ServerReport{w.Run()})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected the stalled handshakes to time out, the run took %v", d)
+	}
+	if rep.ErrorDist[ErrTimeout] != 2 {
+		t.Errorf("Expected 2 timeouts, found %v", rep.ErrorDist)
+	}
+}
+
+func TestConnPerWorker(t *testing.T) {
+	var mu sync.Mutex
+	conns := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr]++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests:      []*http.Request{req},
+		N:             40,
+		C:             4,
+		ConnPerWorker: true,
+		Writer:        ioutil.Discard,
+	}
+	w.Run()
+	if len(conns) != 4 {
+		t.Errorf("Expected 4 connections, found %v", len(conns))
+	}
+	for addr, n := range conns {
+		if n != 10 {
+			t.Errorf("Expected 10 requests on %v, found %v", addr, n)
+		}
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	var mu sync.Mutex
+	conns := make(map[string]int)
+	var bodies int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		conns[r.RemoteAddr]++
+		if string(body) == "payload" {
+			bodies++
+		}
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	for _, c := range []int{1, 4} {
+		conns, bodies = make(map[string]int), 0
+		req, _ := http.NewRequest("POST", server.URL, nil)
+		w := &Work{
+			Requests:           []*http.Request{req},
+			RequestBody:        []byte("payload"),
+			N:                  40,
+			C:                  c,
+			MaxRequestsPerConn: 5,
+			Writer:             ioutil.Discard,
+		}
+		rep := w.Run()
+		if len(rep.Errors) > 0 {
+			t.Errorf("C=%v: Expected no errors, found %v", c, rep.Errors)
+		}
+		if bodies != 40 {
+			t.Errorf("C=%v: Expected 40 requests with their body, found %v", c, bodies)
+		}
+		if len(conns) != 8 {
+			t.Errorf("C=%v: Expected 8 connections, found %v", c, len(conns))
+		}
+		for addr, n := range conns {
+			if n != 5 {
+				t.Errorf("C=%v: Expected 5 requests on %v, found %v", c, addr, n)
+			}
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "app.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	var uri, host string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+		uri, host = r.RequestURI, r.Host
+	}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/path", nil)
+	w := &Work{
+		Requests:   []*http.Request{req},
+		N:          10,
+		C:          2,
+		UnixSocket: socket,
+		Writer:     ioutil.Discard,
+	}
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if count != 10 {
+		t.Errorf("Expected to send 10 requests over the socket, found %v", count)
+	}
+	if uri != "/path" || host != "example.com" {
+		t.Errorf("Expected a request to example.com/path, found %v%v", host, uri)
+	}
+	if rep.ConnsOpened != 2 || rep.ConnLats[len(rep.ConnLats)-1] <= 0 {
+		t.Errorf("Expected 2 timed connections, found %v", rep.ConnsOpened)
+	}
+}
+
+func TestParseUnixURL(t *testing.T) {
+	tests := []struct {
+		in, socket, path string
+	}{
+		{"unix:///var/run/app.sock:/path", "/var/run/app.sock", "/path"},
+		{"unix:///var/run/app.sock:/path?q=1", "/var/run/app.sock", "/path?q=1"},
+		{"unix:///var/run/app.sock", "/var/run/app.sock", "/"},
+		{"unix://app.sock:health", "app.sock", "/health"},
+	}
+	for _, tt := range tests {
+		socket, path, err := ParseUnixURL(tt.in)
+		if err != nil || socket != tt.socket || path != tt.path {
+			t.Errorf("ParseUnixURL(%q) = %q, %q, %v; want %q, %q", tt.in, socket, path, err, tt.socket, tt.path)
+		}
+	}
+	for _, in := range []string{"http://localhost/", "unix://:/path"} {
+		if _, _, err := ParseUnixURL(in); err == nil {
+			t.Errorf("ParseUnixURL(%q) expected to error", in)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	hostport, addr, err := ParseResolve("hey.test:" + port + ":127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://"+hostport, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        4,
+		C:        1,
+		Resolve:  map[string]string{hostport: addr},
+		Writer:   ioutil.Discard,
+	}
+	rep := w.Run()
+	if len(rep.Lats) != 4 {
+		t.Fatalf("Expected 4 successful requests, found %v: %v", len(rep.Lats), rep.Errors)
+	}
+	if host != hostport {
+		t.Errorf("Expected Host %v, found %v", hostport, host)
+	}
+	for _, d := range rep.DnsLats {
+		if d != 0 {
+			t.Errorf("Expected no DNS lookup for a pinned host, found %v", d)
+		}
+	}
+	for _, in := range []string{"hey.test:80", "hey.test:80:not-an-ip", ":80:127.0.0.1"} {
+		if _, _, err := ParseResolve(in); err == nil {
+			t.Errorf("ParseResolve(%q) expected to error", in)
+		}
+	}
+}
+
+func TestDNSServer(t *testing.T) {
+	// A DNS server resolving every name to 127.0.0.1.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var lookups int64
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+				continue
+			}
+			atomic.AddInt64(&lookups, 1)
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			msg.Header.Authoritative = true
+			if q.Type == dnsmessage.TypeA {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				}}
+			}
+			out, err := msg.Pack()
+			if err == nil {
+				pc.WriteTo(out, from)
+			}
+		}
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	req, _ := http.NewRequest("GET", "http://hey.test:"+port, nil)
+	w := &Work{
+		Requests:          []*http.Request{req},
+		N:                 2,
+		C:                 1,
+		DisableKeepAlives: true,
+		DNSServer:         pc.LocalAddr().String(),
+		Writer:            ioutil.Discard,
+	}
+	rep := w.Run()
+	if len(rep.Lats) != 2 {
+		t.Fatalf("Expected 2 successful requests, found %v: %v", len(rep.Lats), rep.Errors)
+	}
+	if atomic.LoadInt64(&lookups) == 0 {
+		t.Errorf("Expected lookups on the DNS server")
+	}
+	for _, d := range rep.DnsLats {
+		if d <= 0 {
+			t.Errorf("Expected DNS lookups to be timed, found %v", d)
+		}
+	}
+}
+
+func TestLocalAddrs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.2 is only routed to the loopback interface by default on Linux")
+	}
+	var mu sync.Mutex
+	var ips map[string]int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		mu.Lock()
+		ips[host]++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	for _, perWorker := range []bool{false, true} {
+		ips = make(map[string]int)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		w := &Work{
+			Requests:           []*http.Request{req},
+			N:                  10,
+			C:                  2,
+			DisableKeepAlives:  !perWorker,
+			LocalAddrs:         []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")},
+			LocalAddrPerWorker: perWorker,
+			Writer:             ioutil.Discard,
+		}
+		rep := w.Run()
+		if len(rep.Errors) > 0 {
+			t.Errorf("perWorker=%v: expected no errors, found %v", perWorker, rep.Errors)
+		}
+		if ips["127.0.0.1"] != 5 || ips["127.0.0.2"] != 5 {
+			t.Errorf("perWorker=%v: expected 5 requests from each local address, found %v", perWorker, ips)
+		}
+	}
+}
+
+func TestLocalAddrNotAvailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests: []*http.Request{req},
+		N:        2,
+		C:        1,
+		// An address of TEST-NET-1, not assigned to any interface.
+		LocalAddrs: []net.IP{net.ParseIP("192.0.2.1")},
+		Writer:     ioutil.Discard,
+	}
+	rep := w.Run()
+	if len(rep.Errors) != 1 {
+		t.Fatalf("Expected one error category, found %v", rep.Errors)
+	}
+	for k, n := range rep.Errors {
+		if n != 2 || !strings.Contains(k, "EADDRNOTAVAIL") {
+			t.Errorf("Expected 2 EADDRNOTAVAIL errors, found %v %v", n, k)
+		}
+	}
+}
+
+// testProxy is an HTTP proxy requiring basic auth as user:pass, or an
+// HTTPS proxy if secure is set. It forwards plain HTTP requests and
+// tunnels CONNECT requests.
+func testProxy(t *testing.T, connects *int64, secure bool) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != "CONNECT" {
+			r.RequestURI = ""
+			r.Header.Del("Proxy-Authorization")
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		atomic.AddInt64(connects, 1)
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(target, buf)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	if secure {
+		s.StartTLS()
+	} else {
+		s.Start()
+	}
+	return s
+}
+
+// testSOCKS5Proxy is a SOCKS5 proxy requiring the user:pass credentials.
+func testSOCKS5Proxy(t *testing.T, connects *int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		// Greeting, username/password method.
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{5, 2})
+		// Username/password auth.
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != "user" || string(pass) != "pass" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+		// CONNECT request.
+		io.ReadFull(conn, buf[:4])
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 3:
+			io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		io.ReadFull(conn, buf[:2])
+		port := binary.BigEndian.Uint16(buf[:2])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		atomic.AddInt64(connects, 1)
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l
+}
+
+func TestProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	var connects int64
+	httpProxy := testProxy(t, &connects, false)
+	defer httpProxy.Close()
+	socksProxy := testSOCKS5Proxy(t, &connects)
+	defer socksProxy.Close()
+
+	tests := []struct {
+		proxy, target string
+		tunnels       int64
+	}{
+		{"http://user:pass@" + httpProxy.Listener.Addr().String(), server.URL, 0},
+		{"http://user:pass@" + httpProxy.Listener.Addr().String(), tlsServer.URL, 2},
+		{"socks5://user:pass@" + socksProxy.Addr().String(), server.URL, 2},
+		{"socks5://user:pass@" + socksProxy.Addr().String(), tlsServer.URL, 2},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt64(&connects, 0)
+		proxyURL, _ := url.Parse(tt.proxy)
+		req, _ := http.NewRequest("GET", tt.target, nil)
+		w := &Work{
+			Requests:  []*http.Request{req},
+			N:         6,
+			C:         2,
+			ProxyAddr: proxyURL,
+			Writer:    ioutil.Discard,
+		}
+		rep := GenClientReport([]ServerReport{w.Run()})
+		if len(rep.ErrorDist) > 0 || rep.StatusCodeDist[200] != 6 {
+			t.Errorf("%v to %v: expected 6 successful requests, found %v %v", tt.proxy, tt.target, rep.StatusCodeDist, rep.ErrorDist)
+		}
+		if got := atomic.LoadInt64(&connects); got != tt.tunnels {
+			t.Errorf("%v to %v: expected %d tunnels, found %v", tt.proxy, tt.target, tt.tunnels, got)
+		}
+		if int64(rep.ProxyConnect.Count) != tt.tunnels {
+			t.Errorf("%v to %v: expected %d timed tunnels, found %v", tt.proxy, tt.target, tt.tunnels, rep.ProxyConnect.Count)
+		}
+	}
+
+	proxyURL, _ := url.Parse("http://user:wrong@" + httpProxy.Listener.Addr().String())
+	req, _ := http.NewRequest("GET", tlsServer.URL, nil)
+	w := &Work{Requests: []*http.Request{req}, N: 1, C: 1, ProxyAddr: proxyURL, Writer: ioutil.Discard}
+	if rep := w.Run(); len(rep.Errors) == 0 {
+		t.Errorf("Expected a tunnel with wrong proxy credentials to fail")
+	}
+
+	// Plain HTTP requests to an HTTPS proxy verify the proxy's name, not
+	// the target's, and the handshake is timed as the proxy phase.
+	httpsProxy := testProxy(t, &connects, true)
+	defer httpsProxy.Close()
+	proxyURL, _ = url.Parse("https://user:pass@" + httpsProxy.Listener.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(httpsProxy.Certificate())
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	w = &Work{
+		Requests:      []*http.Request{req},
+		N:             6,
+		C:             1,
+		ProxyAddr:     proxyURL,
+		TLSVerify:     true,
+		RootCAs:       roots,
+		TLSServerName: "target.invalid",
+		Writer:        ioutil.Discard,
+	}
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if len(rep.ErrorDist) > 0 || rep.StatusCodeDist[200] != 6 {
+		t.Fatalf("Expected 6 successful requests through the HTTPS proxy, found %v %v", rep.StatusCodeDist, rep.ErrorDist)
+	}
+	if rep.ProxyConnect.Count != 1 || rep.TLSHandshakes != 0 {
+		t.Errorf("Expected the proxy handshake to be timed as the proxy phase, found %v proxy and %v TLS handshakes", rep.ProxyConnect.Count, rep.TLSHandshakes)
+	}
+}
+
+func TestRequestFile(t *testing.T) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	bodies := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		counts[r.Method+" "+r.URL.Path]++
+		bodies[r.URL.Path] = string(body) + "|" + r.Header.Get("X-Test")
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "body.json"), []byte(`{"id":3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "requests.jsonl")
+	lines := fmt.Sprintf(`{"url": "%[1]s/items", "weight": 6}
+
+# comments and blank lines are skipped
+{"method": "post", "url": "%[1]s/inline", "headers": {"X-Test": "a"}, "body": "hello", "weight": 3}
+{"method": "PUT", "url": "%[1]s/base64", "body_base64": "aGV5"}
+{"method": "PUT", "url": "%[1]s/file", "body_file": "body.json", "weight": 2}
+`, server.URL)
+	if err := ioutil.WriteFile(file, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rls, err := ReadRequestFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Work{N: 24, C: 2, Writer: ioutil.Discard}
+	for _, l := range rls {
+		req, body, err := l.Request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Requests = append(w.Requests, req)
+		w.RequestBodies = append(w.RequestBodies, body)
+		w.Weights = append(w.Weights, l.Weight)
+	}
+	w.Run()
+
+	want := map[string]int{"GET /items": 12, "POST /inline": 6, "PUT /base64": 2, "PUT /file": 4}
+	for k, v := range want {
+		if counts[k] != v {
+			t.Errorf("Expected %v requests to %q, found %v", v, k, counts[k])
+		}
+	}
+	wantBodies := map[string]string{"/inline": "hello|a", "/base64": "hey|", "/file": `{"id":3}|`}
+	for k, v := range wantBodies {
+		if bodies[k] != v {
+			t.Errorf("Expected body and header %q for %v, found %q", v, k, bodies[k])
+		}
+	}
+
+	counts = make(map[string]int)
+	w = &Work{
+		Requests:      w.Requests,
+		RequestBodies: w.RequestBodies,
+		Weights:       []float64{1, 0, 0, 1},
+		Sample:        true,
+		N:             20,
+		C:             2,
+		Writer:        ioutil.Discard,
+	}
+	w.Run()
+	if counts["GET /items"]+counts["PUT /file"] != 20 {
+		t.Errorf("Expected only requests with a weight to be sampled, found %v", counts)
+	}
+
+	for _, in := range []string{
+		`{"method": "GET"}`,
+		`{"url": "http://localhost", "body": "a", "body_file": "b"}`,
+		`{"url": "http://localhost", "weight": -1}`,
+		`not json`,
+	} {
+		if err := ioutil.WriteFile(file, []byte(in), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadRequestFile(file); err == nil {
+			t.Errorf("ReadRequestFile(%q) expected to error", in)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	log := `10.0.0.1 - frank [10/Oct/2020:13:55:36 +0000] "GET /a?x=1 HTTP/1.1" 200 2326 "-" "curl/7.64"
+{"time": "2020-10-10T13:55:36.4Z", "method": "post", "uri": "/c"}
+10.0.0.2 - - [10/Oct/2020:13:55:36 +0000] "PUT http://example.com/b HTTP/1.1" 200 0
+{"timestamp": 1602338136250, "request": "DELETE /d HTTP/1.1", "status": 204}
+127.0.0.1 - - [10/Oct/2020:13:55:37 +0000] "-" 400 0 "-" "-"
+not a request
+`
+	if err := ioutil.WriteFile(file, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, skipped, err := ReadAccessLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 2 {
+		t.Errorf("Expected 2 skipped lines, found %v", skipped)
+	}
+	sched := ReplaySchedule(entries, 2)
+	wantSched := []time.Duration{0, 0, 125 * time.Millisecond, 200 * time.Millisecond}
+	if fmt.Sprint(sched) != fmt.Sprint(wantSched) {
+		t.Fatalf("Expected schedule %v, found %v", wantSched, sched)
+	}
+
+	w := &Work{C: 2, Schedule: sched, Writer: ioutil.Discard}
+	for _, e := range entries {
+		req, _ := http.NewRequest(e.Method, server.URL+e.URI, nil)
+		w.Requests = append(w.Requests, req)
+	}
+	start := time.Now()
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected the replay to take at least 200ms, took %v", d)
+	}
+	want := []string{"GET /a?x=1", "PUT /b", "DELETE /d", "POST /c"}
+	if len(got) != len(want) || got[2] != want[2] || got[3] != want[3] {
+		t.Errorf("Expected requests %v, found %v", want, got)
+	}
+	if rep.ScheduleDrift.Count != 4 {
+		t.Errorf("Expected the drift of 4 requests, found %v", rep.ScheduleDrift.Count)
+	}
+	if rep.ScheduleDrift.Slowest > 0.1 {
+		t.Errorf("Expected requests to be sent on time, largest drift is %vs", rep.ScheduleDrift.Slowest)
+	}
+}
+
+func TestScheduleSeed(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	run := func() []string {
+		got = nil
+		req, _ := http.NewRequest("POST", server.URL, nil)
+		w := &Work{
+			Requests:    []*http.Request{req, req, req},
+			RequestBody: []byte("{{ .RandString 8 }}"),
+			Template:    true,
+			Schedule:    []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond},
+			Seed:        42,
+			C:           1,
+			Writer:      ioutil.Discard,
+		}
+		w.Run()
+		return got
+	}
+	first, second := run(), run()
+	if len(first) != 3 || fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Errorf("Expected seeded replays to send the same requests, found %v and %v", first, second)
+	}
+}
+
+func TestReadHAR(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, fmt.Sprintf("%s %s %s %s", r.Method, r.URL.Path, r.Header.Get("Cookie"), body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	har := fmt.Sprintf(`{"log": {"version": "1.2", "entries": [
+	{"request": {"method": "GET", "url": "%[1]s/api/items", "headers": [
+		{"name": ":authority", "value": "example.com"},
+		{"name": "cookie", "value": "a=1"},
+		{"name": "cookie", "value": "b=2"}]},
+	 "response": {"content": {"mimeType": "application/json; charset=utf-8"}}},
+	{"request": {"method": "GET", "url": "%[1]s/logo.png", "headers": []},
+	 "response": {"content": {"mimeType": "image/png"}}},
+	{"request": {"method": "GET", "url": "http://cdn.test/app.json", "headers": []},
+	 "response": {"content": {"mimeType": "application/json"}}},
+	{"request": {"method": "POST", "url": "%[1]s/login", "headers": [{"name": "Content-Length", "value": "7"}],
+		"postData": {"mimeType": "application/x-www-form-urlencoded", "params": [{"name": "u", "value": "me"}]}},
+	 "response": {"content": {"mimeType": "application/json"}}},
+	{"request": {"method": "GET", "url": "wss://%[2]s/ws", "headers": []},
+	 "response": {"content": {"mimeType": "application/json"}}},
+	{"request": {"method": "POST", "url": "%[1]s/upload", "headers": [],
+		"postData": {"mimeType": "multipart/form-data", "params": [{"name": "f", "fileName": "a.txt"}]}},
+	 "response": {"content": {"mimeType": "application/json"}}}
+]}}`, server.URL, server.Listener.Addr())
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "session.har")
+	if err := ioutil.WriteFile(file, []byte(har), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	host, _, _ := net.SplitHostPort(server.Listener.Addr().String())
+	lines, skipped, err := ReadHAR(file, HARFilter{Hosts: []string{host}, ContentTypes: []string{"application/json"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 2 || skipped[0].Index != 4 || skipped[1].Index != 5 {
+		t.Errorf("Expected entries 4 and 5 to be skipped, found %v", skipped)
+	}
+
+	w := &Work{N: 4, C: 1, Writer: ioutil.Discard}
+	for _, l := range lines {
+		req, body, err := l.Request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Requests = append(w.Requests, req)
+		w.RequestBodies = append(w.RequestBodies, body)
+	}
+	w.Run()
+	want := []string{"GET /api/items a=1; b=2 ", "POST /login  u=me", "GET /api/items a=1; b=2 ", "POST /login  u=me"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected requests %q, found %q", want, got)
+	}
+}
+
+func TestWeightedMix(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/cart" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	var reqs []*http.Request
+	for _, path := range []string{"/items", "/item/1", "/item/2", "/cart"} {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		reqs = append(reqs, req)
+	}
+	run := func() Report {
+		got = nil
+		w := &Work{
+			Requests: reqs,
+			Weights:  []float64{70, 12.5, 12.5, 5},
+			Names:    []string{"", "item", "item", ""},
+			Sample:   true,
+			Seed:     42,
+			N:        1000,
+			C:        1,
+			Writer:   ioutil.Discard,
+		}
+		return GenClientReport([]ServerReport{w.Run()})
+	}
+	rep := run()
+	first := got
+	run()
+	if fmt.Sprint(first) != fmt.Sprint(got) {
+		t.Errorf("Expected the same sequence of requests with the same seed")
+	}
+
+	if len(rep.EndpointStats) != 3 {
+		t.Fatalf("Expected 3 endpoints, found %v", len(rep.EndpointStats))
+	}
+	want := map[string]float64{"GET " + server.URL + "/items": 0.70, "item": 0.25, "GET " + server.URL + "/cart": 0.05}
+	var total int64
+	for _, e := range rep.EndpointStats {
+		share, ok := want[e.Name]
+		if !ok {
+			t.Errorf("Unexpected endpoint %q", e.Name)
+			continue
+		}
+		if e.Share < share-0.04 || e.Share > share+0.04 {
+			t.Errorf("Expected a share of about %v for %q, found %v", share, e.Name, e.Share)
+		}
+		if strings.HasSuffix(e.Name, "/cart") && e.StatusCodeDist[503] != int(e.Requests) {
+			t.Errorf("Expected only 503 responses for %q, found %v", e.Name, e.StatusCodeDist)
+		}
+		if e.Latency.Count != int(e.Requests) {
+			t.Errorf("Expected %v latencies for %q, found %v", e.Requests, e.Name, e.Latency.Count)
+		}
+		total += e.Requests
+	}
+	if total != 1000 {
+		t.Errorf("Expected 1000 requests over the endpoints, found %v", total)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, fmt.Sprintf("%s?%s %s %s", r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Id"), body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.csv")
+	if err := ioutil.WriteFile(file, []byte("user,token\na,1\nb,2\nc,3\nd,4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	feeder, err := LoadFeeder(file, FeedUnique)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", server.URL+"/items/{{ .Seq }}?w={{ .Worker }}&u={{ .Data.user }}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Id", "{{ .UUID }}")
+	w := &Work{
+		Requests:    []*http.Request{req},
+		RequestBody: []byte(`{"n": {{ .RandInt 5 5 }}, "s": "{{ .RandString 4 }}"}`),
+		Template:    true,
+		Data:        []*Feeder{feeder},
+		N:           8,
+		C:           2,
+		Writer:      ioutil.Discard,
+	}
+	w.Run()
+
+	re := regexp.MustCompile(`^/items/(\d)\?w=(\d)&u=([a-d]) [0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12} {"n": 5, "s": "[a-zA-Z0-9]{4}"}$`)
+	seqs := make(map[string]bool)
+	for _, g := range got {
+		m := re.FindStringSubmatch(g)
+		if m == nil {
+			t.Errorf("Unexpected request %q", g)
+			continue
+		}
+		seqs[m[1]] = true
+		if want := map[string]string{"0": "ac", "1": "bd"}[m[2]]; !strings.Contains(want, m[3]) {
+			t.Errorf("Expected worker %v to use users %q only, found %q", m[2], want, m[3])
+		}
+	}
+	if len(seqs) != 8 {
+		t.Errorf("Expected 8 distinct sequence numbers, found %v", seqs)
+	}
+
+	// The user info and the escaped characters of the URL are kept, UUIDs
+	// differ across runs with the same seed.
+	var paths []string
+	ids := make(map[string]bool)
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		mu.Lock()
+		paths = append(paths, r.URL.EscapedPath()+" "+user+":"+pass)
+		ids[r.Header.Get("X-Id")] = true
+		mu.Unlock()
+	}))
+	defer server2.Close()
+	u, _ := url.Parse(server2.URL)
+	req, _ = http.NewRequest("GET", "http://user:pw@"+u.Host+"/a%2Fb%25c/{{ .Seq }}#frag", nil)
+	req.Header.Set("X-Id", "{{ .UUID }}")
+	for i := 0; i < 2; i++ {
+		w = &Work{Requests: []*http.Request{req}, Template: true, Seed: 1, N: 1, C: 1, Writer: ioutil.Discard}
+		w.Run()
+	}
+	if len(paths) != 2 || paths[0] != "/a%2Fb%25c/0 user:pw" {
+		t.Errorf("Expected the escaped path and user info to be kept, found %v", paths)
+	}
+	if len(ids) != 2 {
+		t.Errorf("Expected distinct UUIDs in seeded runs, found %v", ids)
+	}
+
+	w = &Work{Requests: []*http.Request{req}, RequestBody: []byte("{{ .Seq "), Template: true, N: 1, C: 1}
+	if err := w.Init(); err == nil {
+		t.Errorf("Expected a template that does not compile to fail Init")
+	}
+	rep := w.Run()
+	if len(rep.Errors) != 1 || len(rep.Lats) != 0 {
+		t.Errorf("Expected the run to report the template error, found %v", rep.Errors)
+	}
+}
+
+func TestScenario(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, fmt.Sprintf("%s %s %s", r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("X-Session")))
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/login":
+			if string(body) == `{"user": 1}` {
+				w.Write([]byte(`{}`))
+				return
+			}
+			w.Header().Set("X-Session", "s1")
+			w.Write([]byte(`{"token": "t0", "items": [{"id": 7}]}`))
+		case "/items/7":
+			w.Write([]byte(`<p>cart=42</p>`))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "scenario.jsonl")
+	content := `{"name": "login", "method": "POST", "url": "` + server.URL + `/login", "body": "{\"user\": {{ .Worker }}}", "extract": [{"var": "token", "jsonpath": "$.token"}, {"var": "id", "jsonpath": "$.items[0].id"}, {"var": "session", "header": "X-Session"}], "think": "1ms"}
+# The token of the login is sent with the next steps.
+{"name": "item", "url": "` + server.URL + `/items/{{ .Vars.id }}", "headers": {"Authorization": "Bearer {{ .Vars.token }}", "X-Session": "{{ .Vars.session }}"}, "extract": [{"var": "cart", "regexp": "cart=(\\d+)"}]}
+{"name": "cart", "url": "` + server.URL + `/cart/{{ .Vars.cart }}", "headers": {"Authorization": "Bearer {{ .Vars.token }}"}}
+`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scenario, err := ReadScenario(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reqs []*http.Request
+	var bodies [][]byte
+	var steps []*Step
+	var names []string
+	for _, s := range scenario {
+		req, body, err := s.Request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, err := s.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, req)
+		bodies = append(bodies, body)
+		steps = append(steps, step)
+		names = append(names, s.Name)
+	}
+
+	w := &Work{
+		Requests:      reqs,
+		RequestBodies: bodies,
+		Steps:         steps,
+		Names:         names,
+		N:             4,
+		C:             2,
+		Writer:        ioutil.Discard,
+	}
+	rep := GenClientReport([]ServerReport{w.Run()})
+
+	// Worker 1 cannot log in, its iterations end at the first step.
+	if rep.Iterations.Count != 2 {
+		t.Errorf("Expected 2 completed iterations, found %v", rep.Iterations.Count)
+	}
+	if rep.IterationErrors["extract token: no match"] != 2 {
+		t.Errorf("Expected 2 iterations to fail the login, found %v", rep.IterationErrors)
+	}
+	requests := make(map[string]int64)
+	for _, e := range rep.EndpointStats {
+		requests[e.Name] = e.Requests
+	}
+	if want := map[string]int64{"login": 4, "item": 2, "cart": 2}; fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Errorf("Expected requests by step %v, found %v", want, requests)
+	}
+	counts := make(map[string]int)
+	for _, g := range got {
+		counts[g]++
+	}
+	if counts["/items/7 Bearer t0 s1"] != 2 || counts["/cart/42 Bearer t0 "] != 2 {
+		t.Errorf("Expected the extracted values in the next steps, found %q", got)
+	}
+
+	// Concurrent runs, as those of a server, share the steps.
+	var wg sync.WaitGroup
+	reports := make([]Report, 2)
+	for i := range reports {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := &Work{Requests: reqs, RequestBodies: bodies, Steps: steps, N: 4, C: 2, Writer: ioutil.Discard}
+			reports[i] = GenClientReport([]ServerReport{w.Run()})
+		}(i)
+	}
+	wg.Wait()
+	for _, rep := range reports {
+		if rep.Iterations.Count != 2 {
+			t.Errorf("Expected 2 completed iterations in each concurrent run, found %v", rep.Iterations.Count)
+		}
+	}
+
+	// Iterations failing against different addresses are grouped by error
+	// category across servers.
+	var srs []ServerReport
+	for _, addr := range []string{"http://127.0.0.1:1", "http://127.0.0.1:2"} {
+		req, _ := http.NewRequest("GET", addr, nil)
+		w := &Work{Requests: []*http.Request{req}, Steps: []*Step{{}}, N: 2, C: 1, Writer: ioutil.Discard}
+		srs = append(srs, w.Run())
+	}
+	rep = GenClientReport(srs)
+	if len(rep.IterationErrors) != 1 || rep.IterationErrors[ErrRefused] != 4 || len(rep.IterationErrorSamples[ErrRefused]) != 2 {
+		t.Errorf("Expected 4 refused iterations with 2 samples, found %v %v", rep.IterationErrors, rep.IterationErrorSamples)
+	}
+
+	if _, err := (&ScenarioStep{Extract: []*Extractor{{Var: "a", JSONPath: "$.a", Header: "A"}}}).Step(); err == nil {
+		t.Errorf("Expected an extractor with two sources to be invalid")
+	}
+}
+
+func TestCookies(t *testing.T) {
+	var mu sync.Mutex
+	var anonymous, seeded, other int
+	sessions := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if c, err := r.Cookie("pref"); err == nil && c.Value == "dark" {
+			seeded++
+		}
+		if _, err := r.Cookie("other"); err == nil {
+			other++
+		}
+		c, err := r.Cookie("session")
+		if err != nil {
+			anonymous++
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: strconv.Itoa(anonymous)})
+			return
+		}
+		sessions[c.Value]++
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cookies.txt")
+	content := "# Netscape HTTP Cookie File\n" +
+		"127.0.0.1\tFALSE\t/\tFALSE\t0\tpref\tdark\n" +
+		"#HttpOnly_.example.com\tTRUE\t/\tFALSE\t0\tother\t1\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	seed, err := ReadCookieFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seed) != 2 || seed[0].Domain != "" || seed[1].Domain != "example.com" || !seed[1].HttpOnly {
+		t.Fatalf("Unexpected cookies %+v %+v", seed[0], seed[1])
+	}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requests:    []*http.Request{req},
+		Cookies:     true,
+		SeedCookies: seed,
+		N:           12,
+		C:           3,
+		Writer:      ioutil.Discard,
+	}
+	w.Run()
+	if anonymous != 3 || len(sessions) != 3 {
+		t.Errorf("Expected a session per worker, found %v anonymous requests and sessions %v", anonymous, sessions)
+	}
+	for s, n := range sessions {
+		if n != 3 {
+			t.Errorf("Expected session %v to be used by the 3 next requests of its worker, found %v", s, n)
+		}
+	}
+	if seeded != 12 || other != 0 {
+		t.Errorf("Expected the seeded cookie of the host only, found %v and %v of another domain", seeded, other)
+	}
+
+	anonymous, seeded = 0, 0
+	w = &Work{Requests: []*http.Request{req}, N: 6, C: 2, Writer: ioutil.Discard}
+	w.Run()
+	if anonymous != 6 || seeded != 0 {
+		t.Errorf("Expected no cookies without Cookies, found %v anonymous requests", anonymous)
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "detail": "database unavailable"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer server.Close()
+
+	var assertions []*Assertion
+	for _, s := range []string{
+		"status:200-299,304",
+		"header:Content-Type~json",
+		`body-contains:"ok"`,
+		`body-regexp:^\{"status"`,
+		"jsonpath:$.status=ok",
+		"max-size:32B",
+	} {
+		a, err := ParseAssertion(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertions = append(assertions, a)
+	}
+	ok, _ := http.NewRequest("GET", server.URL+"/ok", nil)
+	bad, _ := http.NewRequest("GET", server.URL+"/bad", nil)
+	w := &Work{
+		Requests:   []*http.Request{ok, bad},
+		Assertions: assertions,
+		N:          10,
+		C:          1,
+		Writer:     ioutil.Discard,
+	}
+	rep := GenClientReport([]ServerReport{w.Run()})
+	if rep.FailedResponses != 5 || len(rep.Lats) != 10 || len(rep.ErrorDist) != 0 {
+		t.Errorf("Expected 5 failed responses out of 10 and no errors, found %v, %v latencies and errors %v", rep.FailedResponses, len(rep.Lats), rep.ErrorDist)
+	}
+	want := map[string]int{
+		"status:200-299,304":       5,
+		"header:Content-Type~json": 5,
+		`body-contains:"ok"`:       5,
+		"jsonpath:$.status=ok":     5,
+		"max-size:32B":             5,
+	}
+	if fmt.Sprint(rep.AssertionFailures) != fmt.Sprint(want) {
+		t.Errorf("Expected failures %v, found %v", want, rep.AssertionFailures)
+	}
+
+	for _, s := range []string{"status", "status:2yy", "status:300-200", "header:", "jsonpath:$.a", "jsonpath:a=1", "max-size:1TB", "body:x"} {
+		if _, err := ParseAssertion(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	ok, _ := http.NewRequest("GET", server.URL, nil)
+	refused, _ := http.NewRequest("GET", "http://127.0.0.1:1", nil)
+	w := &Work{Requests: []*http.Request{ok, refused}, N: 10, C: 1, Writer: ioutil.Discard}
+	sr := w.Run()
+	rep := GenClientReport([]ServerReport{sr})
+	errors := 0
+	for _, n := range rep.ErrorDist {
+		errors += n
+	}
+	if len(rep.Lats) != 5 || errors != 5 {
+		t.Fatalf("Expected the errors to be reported with the results, found %v latencies and %v errors", len(rep.Lats), errors)
+	}
+
+	var ts []*Threshold
+	for _, s := range []string{"error_rate<0.5%", "error_rate<=50%", "errors<6", "requests>=10", "max<20s", "p99<1ns"} {
+		th, err := ParseThreshold(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts = append(ts, th)
+	}
+	if rep.CheckThresholds(ts) {
+		t.Errorf("Expected the run to fail its thresholds")
+	}
+	for i, want := range []bool{false, true, true, true, true, false} {
+		if rep.Thresholds[i].Pass != want {
+			t.Errorf("Expected %v to pass: %v, found %v (%v)", ts[i].Name, want, rep.Thresholds[i].Pass, rep.Thresholds[i].Observed())
+		}
+	}
+
+	// The rate of a distributed run is that of all the servers together.
+	if rep := GenClientReport([]ServerReport{sr, sr}); rep.AggregateRps != 2*sr.Rps {
+		t.Errorf("Expected the rate of two servers to be %v, found %v", 2*sr.Rps, rep.AggregateRps)
+	}
+	rep = Report{Lats: []float64{0.4, 0.1, 0.3, 0.2}, Rps: 450, AggregateRps: 900}
+	for s, want := range map[string]bool{"p50<=0.2s": true, "p75<300ms": false, "p100<=400ms": true, "rps>800": true, "failure_rate<1%": true} {
+		th, err := ParseThreshold(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := th.Check(&rep); res.Pass != want {
+			t.Errorf("Expected %v to pass: %v, found %v", s, want, res.Observed())
+		}
+	}
+	// Thresholds check the percentiles the report prints.
+	for n := 1; n <= 50; n++ {
+		lats := make([]float64, n)
+		for i := range lats {
+			lats[i] = float64(i+1) / 100
+		}
+		for _, d := range percentiles(lats) {
+			if d.Percentage == 0 {
+				continue
+			}
+			th, _ := ParseThreshold(fmt.Sprintf("p%d<1s", d.Percentage))
+			if v, _ := th.actual(&Report{Lats: lats}); v != d.Latency {
+				t.Errorf("Expected p%d of %d latencies to be %v, found %v", d.Percentage, n, d.Latency, v)
+			}
+		}
+	}
+	if (&Report{}).CheckThresholds([]*Threshold{ts[4]}) {
+		t.Errorf("Expected a latency threshold to fail without latencies")
+	}
+
+	for _, s := range []string{"p99", "p0<1s", "p99<300", "latency<1s", "rps>fast"} {
+		if _, err := ParseThreshold(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestClientReportWithoutResponses(t *testing.T) {
+	down, _ := http.NewRequest("GET", "http://127.0.0.1:1", nil)
+	gone, _ := http.NewRequest("GET", "http://127.0.0.1:2", nil)
+	w := &Work{Requests: []*http.Request{down, gone}, Names: []string{"down", "gone"}, N: 4, C: 2, QPS: 100, Writer: ioutil.Discard}
+	sr := w.Run()
+	rep := GenClientReport([]ServerReport{sr, sr})
+
+	errors := 0
+	for _, n := range rep.ErrorDist {
+		errors += n
+	}
+	if errors != 8 || len(rep.ErrorSamples) == 0 {
+		t.Errorf("Expected 8 errors with samples, found %v %v", rep.ErrorDist, rep.ErrorSamples)
+	}
+	if len(rep.EndpointStats) != 2 || rep.EndpointStats[0].Errors != 4 || rep.EndpointStats[1].Errors != 4 {
+		t.Errorf("Expected the errors of the endpoint to be merged, found %+v", rep.EndpointStats)
+	}
+	if rep.Total == 0 || rep.OfferedRate == 0 {
+		t.Errorf("Expected the duration and offered rate to be merged, found %v, %v", rep.Total, rep.OfferedRate)
+	}
+	if rep.LatencyDistribution != nil || rep.Histogram != nil {
+		t.Errorf("Expected no latency summaries, found %v, %v", rep.LatencyDistribution, rep.Histogram)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+	slow, _ := http.NewRequest("GET", server.URL, nil)
+	refused, _ := http.NewRequest("GET", "http://127.0.0.1:1", nil)
+
+	for _, tt := range []struct {
+		req   *http.Request
+		cond  string
+		abort bool
+	}{
+		{slow, "p95>10ms for 200ms", true},
+		{refused, "error_rate>=50% for 200ms", true},
+		// The run is shorter than the window.
+		{refused, "error_rate>=50%", true},
+		{slow, "error_rate>0%", false},
+	} {
+		cond, err := ParseAbortCondition(tt.cond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &Work{
+			Requests:        []*http.Request{tt.req},
+			AbortConditions: []*AbortCondition{cond},
+			N:               20,
+			C:               2,
+			Duration:        5 * time.Second,
+			Writer:          ioutil.Discard,
+		}
+		if tt.abort {
+			w.N = math.MaxInt32
+		}
+		start := time.Now()
+		rep := w.Run()
+		if !tt.abort {
+			if rep.Abort != nil || len(rep.Lats) != 20 {
+				t.Errorf("Expected %q not to abort the run, found %+v after %v requests", tt.cond, rep.Abort, len(rep.Lats))
+			}
+			continue
+		}
+		if rep.Abort == nil {
+			t.Errorf("Expected %q to abort the run", tt.cond)
+			continue
+		}
+		if !strings.HasPrefix(rep.Abort.Reason, tt.cond+" (") || rep.Abort.At < abortCheckInterval {
+			t.Errorf("Expected %q to abort the run after a check interval, found %+v", tt.cond, rep.Abort)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("Expected %q to stop the run early, took %v", tt.cond, d)
+		}
+	}
+
+	// A failure among the first few requests does not decide on its own
+	// before the window fills.
+	var count int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer flaky.Close()
+	req, _ := http.NewRequest("GET", flaky.URL, nil)
+	cond, _ := ParseAbortCondition("error_rate>5% for 10s")
+	w := &Work{Requests: []*http.Request{req}, AbortConditions: []*AbortCondition{cond}, N: 40, C: 2, Writer: ioutil.Discard}
+	rep := w.Run()
+	errors := 0
+	for _, n := range rep.Errors {
+		errors += n
+	}
+	if rep.Abort != nil || errors != 1 || len(rep.Lats) != 39 {
+		t.Errorf("Expected one early error not to abort the run, found %+v, %v", rep.Abort, rep.Errors)
+	}
+
+	// Requests that hang count as latencies while they are in flight.
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer hang.Close()
+	req, _ = http.NewRequest("GET", hang.URL, nil)
+	cond, _ = ParseAbortCondition("p95>100ms for 300ms")
+	w = &Work{Requests: []*http.Request{req}, AbortConditions: []*AbortCondition{cond}, N: 10, C: 2, Writer: ioutil.Discard}
+	start := time.Now()
+	rep = w.Run()
+	if rep.Abort == nil || rep.Abort.At < 300*time.Millisecond || time.Since(start) > 2*time.Second {
+		t.Errorf("Expected hanging requests to abort the run once the window filled, found %+v after %v", rep.Abort, time.Since(start))
+	}
+
+	if c, err := ParseAbortCondition("p95>5s"); err != nil || c.Window != 10*time.Second {
+		t.Errorf("Expected a default window of 10s, found %v, %v", c, err)
+	}
+	for _, s := range []string{"p95>5s for", "p95>5s for 0s", "p95 for 10s"} {
+		if _, err := ParseAbortCondition(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestErrorKey(t *testing.T) {
+	wrap := func(err error) error { return &url.Error{Op: "Get", URL: "http://example.com", Err: err} }
+	dial := func(errno syscall.Errno) error {
+		return wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)})
+	}
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{wrap(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.com"}}), ErrDNS},
+		{wrap(&proxyError{fmt.Errorf("proxy CONNECT to example.com:443: 502 Bad Gateway")}), ErrProxy},
+		{wrap(&net.OpError{Op: "proxyconnect", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), ErrProxy},
+		{wrap(context.Canceled), ErrCancelled},
+		{wrap(context.DeadlineExceeded), ErrTimeout},
+		{wrap(x509.UnknownAuthorityError{}), ErrTLS},
+		{wrap(fmt.Errorf("remote error: tls: bad certificate")), ErrTLS},
+		{dial(syscall.EMFILE), ErrTooManyOpenFiles},
+		{dial(syscall.EADDRNOTAVAIL), ErrLocalAddr},
+		{dial(syscall.ECONNREFUSED), ErrRefused},
+		{wrap(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), ErrReset},
+		{wrap(io.EOF), ErrEOF},
+		{wrap(io.ErrUnexpectedEOF), ErrEOF},
+		{fmt.Errorf(`template: url:1: map has no entry for key "id"`), ErrOther},
+	} {
+		if got := errorKey(tt.err); got != tt.want {
+			t.Errorf("errorKey(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+
+	refused, _ := http.NewRequest("GET", "http://127.0.0.1:1", nil)
+	w := &Work{Requests: []*http.Request{refused}, N: 2, C: 1, Writer: ioutil.Discard}
+	rep := w.Run()
+	if rep.Errors[ErrRefused] != 2 || len(rep.ErrorSamples[ErrRefused]) != 1 || !strings.Contains(rep.ErrorSamples[ErrRefused][0], "127.0.0.1:1") {
+		t.Errorf("Expected 2 refused connections with a sample, found %v %v", rep.Errors, rep.ErrorSamples)
+	}
+
+	var reps []ServerReport
+	for i := 0; i < 3; i++ {
+		reps = append(reps, ServerReport{
+			Errors:       map[string]int{ErrRefused: 2},
+			ErrorSamples: map[string][]string{ErrRefused: {fmt.Sprintf("dial tcp 10.0.0.%d:80: connect: connection refused", i), "dial tcp 10.0.0.9:80: connect: connection refused"}},
+		})
+	}
+	merged := GenClientReport(reps)
+	if merged.ErrorDist[ErrRefused] != 6 || len(merged.ErrorSamples[ErrRefused]) != maxErrorSamples {
+		t.Errorf("Expected the errors of the servers to be merged, found %v %v", merged.ErrorDist, merged.ErrorSamples)
+	}
+}
+
+func TestLatencyBreakdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	up, _ := http.NewRequest("GET", server.URL+"/up", nil)
+	down, _ := http.NewRequest("GET", server.URL+"/down", nil)
+	w := &Work{Requests: []*http.Request{up, down}, Names: []string{"up", "down"}, N: 10, C: 1, Writer: ioutil.Discard}
+	rep := GenClientReport([]ServerReport{w.Run()})
+
+	if len(rep.StatusClassLatency) != 2 {
+		t.Fatalf("Expected latencies for 2 status classes, found %+v", rep.StatusClassLatency)
+	}
+	for i, name := range []string{"2xx", "5xx"} {
+		g := rep.StatusClassLatency[i]
+		if g.Name != name || g.Latency.Count != 5 || len(g.Histogram) == 0 {
+			t.Errorf("Expected 5 latencies and a histogram for %v, found %+v", name, g)
+		}
+	}
+	if len(rep.EndpointStats) != 2 {
+		t.Fatalf("Expected 2 endpoints, found %+v", rep.EndpointStats)
+	}
+	for _, e := range rep.EndpointStats {
+		count := 0
+		for _, b := range e.Histogram {
+			count += b.Count
+		}
+		if count != 5 {
+			t.Errorf("Expected the histogram of %v to count 5 responses, found %v", e.Name, count)
+		}
+	}
+
+	// Without latencies the thresholds have no data, which JSON can encode.
+	rep.Lats = nil
+	th, _ := ParseThreshold("max<1s")
+	if rep.CheckThresholds([]*Threshold{th}) || !rep.Thresholds[0].NoData {
+		t.Errorf("Expected a threshold without data to fail, found %+v", rep.Thresholds[0])
+	}
+	d, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatalf("Expected the report to be encoded as JSON, found %v", err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(d, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.StatusClassLatency) != 2 || len(decoded.EndpointStats) != 2 || decoded.Lats != nil {
+		t.Errorf("Expected the breakdowns without the latencies of each response in JSON, found %s", d)
+	}
+}
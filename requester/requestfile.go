@@ -0,0 +1,181 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RequestLine is one request of a JSON Lines request file, for example:
+//
+//	{"method": "POST", "url": "http://localhost/cart", "headers": {"Content-Type": "application/json"}, "body": "{\"id\": 1}", "weight": 5}
+//
+// At most one of Body, BodyBase64 and BodyFile is set.
+type RequestLine struct {
+	// Method is the HTTP method. Defaults to GET.
+	Method string `json:"method"`
+
+	// URL is the absolute URL of the request.
+	URL string `json:"url"`
+
+	// Headers are the headers of the request.
+	Headers map[string]string `json:"headers"`
+
+	// Body is the body of the request as text.
+	Body string `json:"body"`
+
+	// BodyBase64 is the body of the request, base64 encoded.
+	BodyBase64 string `json:"body_base64"`
+
+	// BodyFile is the path of a file holding the body of the request. A
+	// relative path is relative to the directory of the request file.
+	BodyFile string `json:"body_file"`
+
+	// Weight is the share of the request in the mix, relative to the
+	// weights of the other requests. Defaults to 1.
+	Weight float64 `json:"weight"`
+
+	// Name is the name results of the request are reported under.
+	// Defaults to the method and the URL without the query.
+	Name string `json:"name"`
+}
+
+// ReadRequestFile reads a JSON Lines request file, one RequestLine per
+// line. Blank lines and lines starting with # are skipped.
+func ReadRequestFile(path string) ([]*RequestLine, error) {
+	var lines []*RequestLine
+	err := readJSONLines(path, func(line []byte) error {
+		l := new(RequestLine)
+		if err := json.Unmarshal(line, l); err != nil {
+			return err
+		}
+		if err := l.check(); err != nil {
+			return err
+		}
+		l.BodyFile = resolvePath(path, l.BodyFile)
+		lines = append(lines, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s: no requests", path)
+	}
+	return lines, nil
+}
+
+// readJSONLines calls fn with each line of the file at path, skipping
+// blank lines and lines starting with #. Errors of fn are prefixed with
+// the file name and the line number.
+func readJSONLines(path string, fn func(line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 16<<20)
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return s.Err()
+}
+
+// resolvePath returns name, relative to the directory of the file at
+// path if it is a relative path.
+func resolvePath(path, name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+func (l *RequestLine) check() error {
+	if l.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	bodies := 0
+	for _, b := range []string{l.Body, l.BodyBase64, l.BodyFile} {
+		if b != "" {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return fmt.Errorf("only one of body, body_base64 and body_file can be set")
+	}
+	if l.Weight < 0 {
+		return fmt.Errorf("weight cannot be negative")
+	}
+	if l.Weight == 0 {
+		l.Weight = 1
+	}
+	return nil
+}
+
+// Request returns the request and the body of l. The body is not set on
+// the request, it is passed to Work in RequestBodies.
+func (l *RequestLine) Request() (*http.Request, []byte, error) {
+	var body []byte
+	switch {
+	case l.Body != "":
+		body = []byte(l.Body)
+	case l.BodyBase64 != "":
+		b, err := base64.StdEncoding.DecodeString(l.BodyBase64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid body_base64: %v", err)
+		}
+		body = b
+	case l.BodyFile != "":
+		b, err := ioutil.ReadFile(l.BodyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = b
+	}
+	method := strings.ToUpper(l.Method)
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, l.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range l.Headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	return req, body, nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Step is a step of a scenario, the request at the same index in
+// Work.Requests.
+type Step struct {
+	// Extract are the values extracted from the response into variables.
+	Extract []*Extractor
+
+	// ThinkTime is the pause the worker takes after the step. Optional.
+	ThinkTime *ThinkTime
+}
+
+// Extractor extracts a value from a response into a variable. Exactly one
+// of JSONPath, Regexp and Header is set.
+type Extractor struct {
+	// Var is the name of the variable.
+	Var string `json:"var"`
+
+	// JSONPath selects the value in a JSON body, such as $.items[0].id.
+	// Strings are extracted as is, other values as JSON.
+	JSONPath string `json:"jsonpath"`
+
+	// Regexp matches the body. The value is the first submatch, or the
+	// whole match if the expression has no group.
+	Regexp string `json:"regexp"`
+
+	// Header is the name of the response header holding the value.
+	Header string `json:"header"`
+
+	path []interface{} // field names and indexes of JSONPath
+	re   *regexp.Regexp
+}
+
+// compile returns a copy of s with its extractors compiled, leaving s
+// untouched.
+func (s *Step) compile() (*Step, error) {
+	c := *s
+	c.Extract = make([]*Extractor, len(s.Extract))
+	for i, e := range s.Extract {
+		ce := *e
+		if err := ce.compile(); err != nil {
+			return nil, err
+		}
+		c.Extract[i] = &ce
+	}
+	return &c, nil
+}
+
+// needsBody reports whether values are extracted from the body.
+func (s *Step) needsBody() bool {
+	for _, e := range s.Extract {
+		if e.JSONPath != "" || e.Regexp != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// extract extracts the values of the step from r into vars.
+func (s *Step) extract(r *response, vars map[string]string) error {
+	for _, e := range s.Extract {
+		var v string
+		var ok bool
+		switch {
+		case e.Header != "":
+			v = r.resp.Header.Get(e.Header)
+			ok = v != ""
+		case e.re != nil:
+			m := e.re.FindSubmatch(r.body)
+			if ok = m != nil; ok {
+				v = string(m[0])
+				if len(m) > 1 {
+					v = string(m[1])
+				}
+			}
+		default:
+			doc, err := r.json()
+			if err != nil {
+				return &stepError{fmt.Sprintf("extract %s: %v", e.Var, err)}
+			}
+			v, ok = jsonLookup(doc, e.path)
+		}
+		if !ok {
+			return &stepError{fmt.Sprintf("extract %s: no match", e.Var)}
+		}
+		vars[e.Var] = v
+	}
+	return nil
+}
+
+func (e *Extractor) compile() error {
+	n := 0
+	for _, s := range []string{e.JSONPath, e.Regexp, e.Header} {
+		if s != "" {
+			n++
+		}
+	}
+	if e.Var == "" || n != 1 {
+		return fmt.Errorf("extractor %q: want a var and one of jsonpath, regexp and header", e.Var)
+	}
+	var err error
+	switch {
+	case e.Regexp != "":
+		e.re, err = regexp.Compile(e.Regexp)
+	case e.JSONPath != "":
+		e.path, err = parseJSONPath(e.JSONPath)
+	}
+	if err != nil {
+		return fmt.Errorf("extractor %q: %v", e.Var, err)
+	}
+	return nil
+}
+
+// parseJSONPath parses the subset of JSONPath made of field names and
+// array indexes: $.a.b[0]['c d'].
+func parseJSONPath(p string) ([]interface{}, error) {
+	s := strings.TrimPrefix(p, "$")
+	var path []interface{}
+	for s != "" {
+		switch {
+		case s[0] == '.':
+			s = s[1:]
+			i := strings.IndexAny(s, ".[")
+			if i < 0 {
+				i = len(s)
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", p)
+			}
+			path = append(path, s[:i])
+			s = s[i:]
+		case strings.HasPrefix(s, "['"):
+			i := strings.Index(s, "']")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", p)
+			}
+			path = append(path, s[2:i])
+			s = s[i+2:]
+		case s[0] == '[':
+			i := strings.Index(s, "]")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", p)
+			}
+			n, err := strconv.Atoi(s[1:i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSONPath %q", p)
+			}
+			path = append(path, n)
+			s = s[i+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q", p)
+		}
+	}
+	return path, nil
+}
+
+// jsonLookup returns the value at path in doc. Strings are returned as
+// is, other values as JSON.
+func jsonLookup(doc interface{}, path []interface{}) (string, bool) {
+	v := doc
+	for _, k := range path {
+		switch k := k.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if v, ok = m[k]; !ok {
+				return "", false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || k < 0 || k >= len(a) {
+				return "", false
+			}
+			v = a[k]
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case nil:
+		return "", false
+	default:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	}
+}
+
+// runIteration makes the requests of the scenario in order from worker w
+// and reports the iteration. The iteration ends at the first step that
+// fails. An iteration stopped with the run is not reported.
+func (b *Work) runIteration(ctx context.Context, c *http.Client, streams chan struct{}, w *worker) {
+	start := now()
+	var think time.Duration
+	w.vars = make(map[string]string)
+	var err error
+	for i, step := range b.steps {
+		if err = b.send(ctx, c, streams, i, w); err != nil {
+			break
+		}
+		if step.ThinkTime != nil && i < len(b.steps)-1 {
+			d := step.ThinkTime.next(w.rnd)
+			if !sleep(ctx, d) {
+				return
+			}
+			think += d
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	b.results <- &result{iteration: true, err: err, duration: now() - start - think}
+}
+
+// ScenarioStep is a step of a JSON Lines scenario file, a RequestLine with
+// extractors and a think time, for example:
+//
+//	{"name": "login", "method": "POST", "url": "http://localhost/login", "body": "{\"user\": \"{{ .Data.user }}\"}", "extract": [{"var": "token", "jsonpath": "$.token"}], "think": "1s"}
+//	{"name": "items", "url": "http://localhost/items", "headers": {"Authorization": "Bearer {{ .Vars.token }}"}}
+type ScenarioStep struct {
+	RequestLine
+	Extract []*Extractor `json:"extract"`
+	// Think is the think time after the step, in the format of
+	// ParseThinkTime.
+	Think string `json:"think"`
+}
+
+// Step returns the Step of s.
+func (s *ScenarioStep) Step() (*Step, error) {
+	step := &Step{Extract: s.Extract}
+	if s.Think != "" {
+		t, err := ParseThinkTime(s.Think)
+		if err != nil {
+			return nil, err
+		}
+		step.ThinkTime = t
+	}
+	// The extractors are compiled to report their errors when the
+	// scenario is read. Init compiles them again for each run.
+	if _, err := step.compile(); err != nil {
+		return nil, err
+	}
+	return step, nil
+}
+
+// ReadScenario reads a JSON Lines scenario file, one ScenarioStep per
+// line in the order they are run. Blank lines and lines starting with #
+// are skipped.
+func ReadScenario(path string) ([]*ScenarioStep, error) {
+	var steps []*ScenarioStep
+	err := readJSONLines(path, func(line []byte) error {
+		step := new(ScenarioStep)
+		if err := json.Unmarshal(line, step); err != nil {
+			return err
+		}
+		if err := step.check(); err != nil {
+			return err
+		}
+		step.BodyFile = resolvePath(path, step.BodyFile)
+		steps = append(steps, step)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	return steps, nil
+}
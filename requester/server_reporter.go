@@ -2,6 +2,7 @@ package requester
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"time"
 )
@@ -11,6 +12,7 @@ type ServerReport struct {
 	TotalDuration time.Duration `json:"totalDuration"`
 	AvgTotal      float64       `json:"avgTotal"`
 	Rps           float64       `json:"rps"`
+	OfferedRate   float64       `json:"offeredRate"`
 	ContentLength int64         `json:"contentLength"`
 	AvgConn       float64       `json:"avgConn"`
 	AvgDNS        float64       `json:"avgDNS"`
@@ -25,27 +27,76 @@ type ServerReport struct {
 	DelayLats     []float64     `json:"delayLats"`
 	Offsets       []float64     `json:"offsets"`
 	StatusCodes   []int         `json:"statusCodes"`
+	ConnReused    []bool        `json:"connReused"`
+	IdleTimes     []float64     `json:"idleTimes"`
+	ConnsOpened   int64         `json:"connsOpened"`
 
-	Errors map[string]int `json:"errors"`
+	// ConnRequests and ConnPeakStreams hold, for each connection, the
+	// number of requests it carried and the peak number in flight at once.
+	ConnRequests    []int `json:"connRequests"`
+	ConnPeakStreams []int `json:"connPeakStreams"`
+
+	ProxyLats       []float64      `json:"proxyLats"`
+	TLSLats         []float64      `json:"tlsLats"`
+	TLSHandshakes   int64          `json:"tlsHandshakes"`
+	TLSResumed      int64          `json:"tlsResumed"`
+	TLSVersions     map[string]int `json:"tlsVersions"`
+	TLSCipherSuites map[string]int `json:"tlsCipherSuites"`
+	ALPNProtocols   map[string]int `json:"alpnProtocols"`
+
+	// Drifts are how late each request was sent on its schedule, when
+	// replaying one.
+	Drifts []float64 `json:"drifts"`
+
+	// EndpointNames are the names of the endpoints, when requests were
+	// sent to more than one. Endpoints holds, for each of Lats, the index
+	// of its endpoint in EndpointNames, and EndpointErrors the number of
+	// errors of each endpoint.
+	EndpointNames  []string `json:"endpointNames"`
+	Endpoints      []int    `json:"endpoints"`
+	EndpointErrors []int    `json:"endpointErrors"`
+
+	// IterationLats are the durations of the completed scenario
+	// iterations, and IterationErrors counts the failed ones by error
+	// category, with samples as ErrorSamples.
+	IterationLats         []float64           `json:"iterationLats"`
+	IterationErrors       map[string]int      `json:"iterationErrors"`
+	IterationErrorSamples map[string][]string `json:"iterationErrorSamples"`
+
+	// FailedResponses is the number of responses that failed at least one
+	// assertion, and AssertionFailures counts the failures by assertion.
+	FailedResponses   int64          `json:"failedResponses"`
+	AssertionFailures map[string]int `json:"assertionFailures"`
+
+	// Abort is why and when the run was stopped by an abort condition,
+	// nil if it was not.
+	Abort *Abort `json:"abort"`
+
+	// Errors counts the errors by category, ErrorSamples holds a few
+	// distinct messages of each category.
+	Errors       map[string]int      `json:"errors"`
+	ErrorSamples map[string][]string `json:"errorSamples"`
 }
 
 func GenClientReport(reps []ServerReport) Report {
-	// TODO: 適当
-	var isError bool
+	// The report is merged even if no request succeeded, only the latency
+	// summaries are left empty then.
+	errorDist := make(map[string]int)
+	errorSamples := make(map[string][]string)
+	var aborts []Abort
 	for _, rep := range reps {
-		if len(rep.Errors) > 0 {
-			for k := range rep.Errors {
-				fmt.Println("Error:", k)
+		mergeCounts(errorDist, rep.Errors)
+		for k, samples := range rep.ErrorSamples {
+			for _, s := range samples {
+				addErrorSample(errorSamples, k, s)
 			}
-			isError = true
-			break
 		}
-	}
-	if isError {
-		return Report{}
+		if rep.Abort != nil {
+			aborts = append(aborts, *rep.Abort)
+		}
 	}
 
-	snapshot := Report{}
+	snapshot := Report{ErrorDist: errorDist, ErrorSamples: errorSamples, Aborts: aborts}
 	snapshot.AvgTotal = func() float64 {
 		var sum float64
 		for _, rep := range reps {
@@ -61,6 +112,15 @@ func GenClientReport(reps []ServerReport) Report {
 		}
 		return sum / float64(len(reps))
 	}()
+	snapshot.AggregateRps = snapshot.Rps * float64(len(reps))
+	// Each server offers its own load, so the offered rates add up.
+	snapshot.OfferedRate = func() float64 {
+		var sum float64
+		for _, rep := range reps {
+			sum += rep.OfferedRate
+		}
+		return sum
+	}()
 	snapshot.SizeTotal = func() int64 {
 		var sum int64
 		for _, rep := range reps {
@@ -126,6 +186,70 @@ func GenClientReport(reps []ServerReport) Report {
 	for _, rep := range reps {
 		snapshot.StatusCodes = append(snapshot.StatusCodes, rep.StatusCodes...)
 	}
+	for _, rep := range reps {
+		snapshot.ConnReused = append(snapshot.ConnReused, rep.ConnReused...)
+	}
+	var idleTimes []float64
+	for _, rep := range reps {
+		idleTimes = append(idleTimes, rep.IdleTimes...)
+		snapshot.ConnsOpened += rep.ConnsOpened
+	}
+	var connRequests, connPeakStreams []int
+	for _, rep := range reps {
+		connRequests = append(connRequests, rep.ConnRequests...)
+		connPeakStreams = append(connPeakStreams, rep.ConnPeakStreams...)
+	}
+	snapshot.ConnLoad = connLoad(connRequests, connPeakStreams)
+
+	var proxyLats []float64
+	for _, rep := range reps {
+		proxyLats = append(proxyLats, rep.ProxyLats...)
+	}
+	snapshot.ProxyConnect = latencyStats(proxyLats)
+
+	var drifts []float64
+	for _, rep := range reps {
+		drifts = append(drifts, rep.Drifts...)
+	}
+	snapshot.ScheduleDrift = latencyStats(drifts)
+	snapshot.EndpointStats = endpointStats(reps)
+
+	var iterationLats []float64
+	snapshot.IterationErrors = make(map[string]int)
+	snapshot.IterationErrorSamples = make(map[string][]string)
+	for _, rep := range reps {
+		iterationLats = append(iterationLats, rep.IterationLats...)
+		mergeCounts(snapshot.IterationErrors, rep.IterationErrors)
+		for k, samples := range rep.IterationErrorSamples {
+			for _, s := range samples {
+				addErrorSample(snapshot.IterationErrorSamples, k, s)
+			}
+		}
+	}
+	snapshot.Iterations = latencyStats(iterationLats)
+
+	snapshot.AssertionFailures = make(map[string]int)
+	for _, rep := range reps {
+		snapshot.FailedResponses += rep.FailedResponses
+		mergeCounts(snapshot.AssertionFailures, rep.AssertionFailures)
+	}
+
+	var tlsLats []float64
+	snapshot.TLSVersions = make(map[string]int)
+	snapshot.TLSCipherSuites = make(map[string]int)
+	snapshot.ALPNProtocols = make(map[string]int)
+	for _, rep := range reps {
+		tlsLats = append(tlsLats, rep.TLSLats...)
+		snapshot.TLSHandshakes += rep.TLSHandshakes
+		snapshot.TLSResumed += rep.TLSResumed
+		mergeCounts(snapshot.TLSVersions, rep.TLSVersions)
+		mergeCounts(snapshot.TLSCipherSuites, rep.TLSCipherSuites)
+		mergeCounts(snapshot.ALPNProtocols, rep.ALPNProtocols)
+	}
+	if snapshot.TLSHandshakes > 0 {
+		snapshot.TLSResumptionRate = float64(snapshot.TLSResumed) / float64(snapshot.TLSHandshakes)
+	}
+	snapshot.TLSHandshake = latencyStats(tlsLats)
 	snapshot.Offsets = []float64{}
 	for _, rep := range reps {
 		snapshot.Offsets = append(snapshot.Offsets, rep.Offsets...)
@@ -136,32 +260,57 @@ func GenClientReport(reps []ServerReport) Report {
 		}
 	}
 
-	sort.Float64s(snapshot.Lats)
-	snapshot.Fastest = snapshot.Lats[0]
-	snapshot.Slowest = snapshot.Lats[len(snapshot.Lats)-1]
+	// Group the latencies by status code class before the slices get
+	// sorted.
+	snapshot.StatusClassLatency = statusClassLatency(snapshot.Lats, snapshot.StatusCodes)
+
+	// Split the latencies by connection before the slices get sorted.
+	var newConnLats, reusedConnLats []float64
+	for i, reused := range snapshot.ConnReused {
+		if i >= len(snapshot.Lats) {
+			break
+		}
+		if reused {
+			reusedConnLats = append(reusedConnLats, snapshot.Lats[i])
+		} else {
+			newConnLats = append(newConnLats, snapshot.Lats[i])
+		}
+	}
+	snapshot.NewConnRequests = int64(len(newConnLats))
+	snapshot.ReusedConnRequests = int64(len(reusedConnLats))
+	snapshot.NewConnLatency = latencyStats(newConnLats)
+	snapshot.ReusedConnLatency = latencyStats(reusedConnLats)
+	sort.Float64s(idleTimes)
+	snapshot.IdleTimeDistribution = percentiles(idleTimes)
+
+	if len(snapshot.Lats) > 0 {
+		sort.Float64s(snapshot.Lats)
+		snapshot.Fastest = snapshot.Lats[0]
+		snapshot.Slowest = snapshot.Lats[len(snapshot.Lats)-1]
 
-	sort.Float64s(snapshot.ConnLats)
-	snapshot.ConnMax = snapshot.ConnLats[0]
-	snapshot.ConnMin = snapshot.ConnLats[len(snapshot.ConnLats)-1]
+		sort.Float64s(snapshot.ConnLats)
+		snapshot.ConnMax = snapshot.ConnLats[0]
+		snapshot.ConnMin = snapshot.ConnLats[len(snapshot.ConnLats)-1]
 
-	sort.Float64s(snapshot.DnsLats)
-	snapshot.DnsMax = snapshot.DnsLats[0]
-	snapshot.DnsMin = snapshot.DnsLats[len(snapshot.DnsLats)-1]
+		sort.Float64s(snapshot.DnsLats)
+		snapshot.DnsMax = snapshot.DnsLats[0]
+		snapshot.DnsMin = snapshot.DnsLats[len(snapshot.DnsLats)-1]
 
-	sort.Float64s(snapshot.ReqLats)
-	snapshot.ReqMax = snapshot.ReqLats[0]
-	snapshot.ReqMin = snapshot.ReqLats[len(snapshot.ReqLats)-1]
+		sort.Float64s(snapshot.ReqLats)
+		snapshot.ReqMax = snapshot.ReqLats[0]
+		snapshot.ReqMin = snapshot.ReqLats[len(snapshot.ReqLats)-1]
 
-	sort.Float64s(snapshot.DelayLats)
-	snapshot.DelayMax = snapshot.DelayLats[0]
-	snapshot.DelayMin = snapshot.DelayLats[len(snapshot.DelayLats)-1]
+		sort.Float64s(snapshot.DelayLats)
+		snapshot.DelayMax = snapshot.DelayLats[0]
+		snapshot.DelayMin = snapshot.DelayLats[len(snapshot.DelayLats)-1]
 
-	sort.Float64s(snapshot.ResLats)
-	snapshot.ResMax = snapshot.ResLats[0]
-	snapshot.ResMin = snapshot.ResLats[len(snapshot.ResLats)-1]
+		sort.Float64s(snapshot.ResLats)
+		snapshot.ResMax = snapshot.ResLats[0]
+		snapshot.ResMin = snapshot.ResLats[len(snapshot.ResLats)-1]
 
-	snapshot.Histogram = histrgramForClientReport(snapshot)
-	snapshot.LatencyDistribution = latenciesForClientReport(snapshot)
+		snapshot.Histogram = histrgramForClientReport(snapshot)
+		snapshot.LatencyDistribution = latenciesForClientReport(snapshot)
+	}
 
 	statusCodeDist := make(map[int]int, len(snapshot.StatusCodes))
 	for _, statusCode := range snapshot.StatusCodes {
@@ -172,15 +321,139 @@ func GenClientReport(reps []ServerReport) Report {
 	return snapshot
 }
 
+// endpointStats merges the results of the endpoints of reps by name, in
+// the order they first appear.
+func endpointStats(reps []ServerReport) []EndpointStats {
+	var stats []EndpointStats
+	var lats [][]float64
+	index := make(map[string]int)
+	var total int64
+	for _, rep := range reps {
+		if len(rep.EndpointNames) == 0 {
+			continue
+		}
+		// Map the endpoints of rep to the merged ones.
+		ids := make([]int, len(rep.EndpointNames))
+		for i, name := range rep.EndpointNames {
+			j, ok := index[name]
+			if !ok {
+				j = len(stats)
+				index[name] = j
+				stats = append(stats, EndpointStats{Name: name, StatusCodeDist: make(map[int]int)})
+				lats = append(lats, nil)
+			}
+			ids[i] = j
+			if i < len(rep.EndpointErrors) {
+				stats[j].Errors += int64(rep.EndpointErrors[i])
+				stats[j].Requests += int64(rep.EndpointErrors[i])
+				total += int64(rep.EndpointErrors[i])
+			}
+		}
+		for k, e := range rep.Endpoints {
+			if k >= len(rep.Lats) || e >= len(ids) {
+				break
+			}
+			j := ids[e]
+			lats[j] = append(lats[j], rep.Lats[k])
+			if k < len(rep.StatusCodes) {
+				stats[j].StatusCodeDist[rep.StatusCodes[k]]++
+			}
+			stats[j].Requests++
+			total++
+		}
+	}
+	for j := range stats {
+		stats[j].Latency = latencyStats(lats[j])
+		stats[j].Histogram = latencyHistogram(lats[j])
+		if total > 0 {
+			stats[j].Share = float64(stats[j].Requests) / float64(total)
+		}
+	}
+	return stats
+}
+
+// statusClassLatency groups lats by the class of their status code in
+// codes, such as 2xx, in the order of the classes.
+func statusClassLatency(lats []float64, codes []int) []LatencyGroup {
+	classes := make(map[int][]float64)
+	for i, code := range codes {
+		if i >= len(lats) {
+			break
+		}
+		classes[code/100] = append(classes[code/100], lats[i])
+	}
+	var groups []LatencyGroup
+	for c := 1; c <= 5; c++ {
+		if l, ok := classes[c]; ok {
+			// latencyStats sorts l for the histogram.
+			stats := latencyStats(l)
+			groups = append(groups, LatencyGroup{
+				Name:      fmt.Sprintf("%dxx", c),
+				Latency:   stats,
+				Histogram: latencyHistogram(l),
+			})
+		}
+	}
+	return groups
+}
+
+func connLoad(requests, peak []int) ConnLoad {
+	load := ConnLoad{Conns: len(requests)}
+	if load.Conns == 0 {
+		return load
+	}
+	var sumRequests, sumPeak int
+	for i := range requests {
+		sumRequests += requests[i]
+		sumPeak += peak[i]
+		if requests[i] > load.MaxRequests {
+			load.MaxRequests = requests[i]
+		}
+		if peak[i] > load.MaxPeakStreams {
+			load.MaxPeakStreams = peak[i]
+		}
+	}
+	load.AvgRequests = float64(sumRequests) / float64(load.Conns)
+	load.AvgPeakStreams = float64(sumPeak) / float64(load.Conns)
+	return load
+}
+
+func mergeCounts(dst, src map[string]int) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
 func latenciesForClientReport(snapshot Report) []LatencyDistribution {
+	return percentiles(snapshot.Lats)
+}
+
+// latencyStats summarizes lats. lats is sorted in place.
+func latencyStats(lats []float64) LatencyStats {
+	if len(lats) == 0 {
+		return LatencyStats{}
+	}
+	sort.Float64s(lats)
+	var sum float64
+	for _, l := range lats {
+		sum += l
+	}
+	return LatencyStats{
+		Count:               len(lats),
+		Average:             sum / float64(len(lats)),
+		Fastest:             lats[0],
+		Slowest:             lats[len(lats)-1],
+		LatencyDistribution: percentiles(lats),
+	}
+}
+
+// percentiles returns the latency distribution of the sorted lats.
+func percentiles(lats []float64) []LatencyDistribution {
 	pctls := []int{10, 25, 50, 75, 90, 95, 99}
 	data := make([]float64, len(pctls))
-	j := 0
-	for i := 0; i < len(snapshot.Lats) && j < len(pctls); i++ {
-		current := i * 100 / len(snapshot.Lats)
-		if current >= pctls[j] {
-			data[j] = snapshot.Lats[i]
-			j++
+	if len(lats) > 0 {
+		for j, p := range pctls {
+			data[j] = latencyAt(lats, float64(p))
 		}
 	}
 	res := make([]LatencyDistribution, len(pctls))
@@ -192,19 +465,39 @@ func latenciesForClientReport(snapshot Report) []LatencyDistribution {
 	return res
 }
 
+// latencyAt returns the p-th percentile of the sorted, non-empty lats, by
+// nearest rank. The distributions and thresholds share it, so that a
+// threshold is checked against the percentile the report prints.
+func latencyAt(lats []float64, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(lats))/100)) - 1
+	if i < 0 {
+		i = 0
+	}
+	return lats[i]
+}
+
 func histrgramForClientReport(snapshot Report) []Bucket {
+	return latencyHistogram(snapshot.Lats)
+}
+
+// latencyHistogram returns the histogram of the sorted lats.
+func latencyHistogram(lats []float64) []Bucket {
+	if len(lats) == 0 {
+		return nil
+	}
+	fastest, slowest := lats[0], lats[len(lats)-1]
 	bc := 10
 	buckets := make([]float64, bc+1)
 	counts := make([]int, bc+1)
-	bs := (snapshot.Slowest - snapshot.Fastest) / float64(bc)
+	bs := (slowest - fastest) / float64(bc)
 	for i := 0; i < bc; i++ {
-		buckets[i] = snapshot.Fastest + bs*float64(i)
+		buckets[i] = fastest + bs*float64(i)
 	}
-	buckets[bc] = snapshot.Slowest
+	buckets[bc] = slowest
 	var bi int
 	var max int
-	for i := 0; i < len(snapshot.Lats); {
-		if snapshot.Lats[i] <= buckets[bi] {
+	for i := 0; i < len(lats); {
+		if lats[i] <= buckets[bi] {
 			i++
 			counts[bi]++
 			if max < counts[bi] {
@@ -219,7 +512,7 @@ func histrgramForClientReport(snapshot Report) []Bucket {
 		res[i] = Bucket{
 			Mark:      buckets[i],
 			Count:     counts[i],
-			Frequency: float64(counts[i]) / float64(len(snapshot.Lats)),
+			Frequency: float64(counts[i]) / float64(len(lats)),
 		}
 	}
 	return res
@@ -0,0 +1,334 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"bufio"
+	"bytes"
+	crand "crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Feeder modes, how rows are handed to requests.
+const (
+	// FeedSequential hands the rows in order to the requests of all
+	// workers, starting over at the end.
+	FeedSequential = "sequential"
+	// FeedRandom hands a random row to each request.
+	FeedRandom = "random"
+	// FeedUnique splits the rows between the workers, so that no two
+	// workers use the same row. Each worker cycles through its rows.
+	FeedUnique = "unique"
+)
+
+// Feeder feeds the rows of a data file to request templates.
+type Feeder struct {
+	// Rows are the rows of the data file, by column name.
+	Rows []map[string]string
+
+	// Mode is one of "sequential", "random" or "unique". Defaults to
+	// sequential.
+	Mode string
+
+	next uint64
+}
+
+// LoadFeeder reads the rows of a CSV file with a header line, or of a
+// JSON Lines file if path ends with .jsonl or .ndjson.
+func LoadFeeder(path, mode string) (*Feeder, error) {
+	switch mode {
+	case "":
+		mode = FeedSequential
+	case FeedSequential, FeedRandom, FeedUnique:
+	default:
+		return nil, fmt.Errorf("invalid feeder mode %q, want sequential, random or unique", mode)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []map[string]string
+	if strings.HasSuffix(path, ".jsonl") || strings.HasSuffix(path, ".ndjson") {
+		rows, err = readJSONRows(f)
+	} else {
+		rows, err = readCSVRows(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no rows", path)
+	}
+	return &Feeder{Rows: rows, Mode: mode}, nil
+}
+
+func readCSVRows(r io.Reader) ([]map[string]string, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			row[name] = rec[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readJSONRows(r io.Reader) ([]map[string]string, error) {
+	var rows []map[string]string
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		d := json.NewDecoder(bytes.NewReader(line))
+		d.UseNumber()
+		var fields map[string]interface{}
+		if err := d.Decode(&fields); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		row := make(map[string]string, len(fields))
+		for k, v := range fields {
+			switch v := v.(type) {
+			case string:
+				row[k] = v
+			case json.Number:
+				row[k] = v.String()
+			default:
+				b, _ := json.Marshal(v)
+				row[k] = string(b)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, s.Err()
+}
+
+// worker is the state of a worker, that request templates and connection
+// recycling depend on.
+type worker struct {
+	id  int
+	rnd *rand.Rand
+	// uses counts the rows each feeder in unique mode handed to the worker.
+	uses []int
+	// vars are the values extracted by the steps of the current iteration.
+	vars map[string]string
+	// connRequests counts the requests carried by the idle connection of
+	// the worker's transport for each connection key, with
+	// MaxRequestsPerConn.
+	connRequests map[string]int
+}
+
+// row returns the row of f for the next request of w, the index of f in
+// Work.Data being i.
+func (f *Feeder) row(w *worker, i, workers int) map[string]string {
+	switch f.Mode {
+	case FeedRandom:
+		return f.Rows[w.rnd.Intn(len(f.Rows))]
+	case FeedUnique:
+		// The worker takes the rows w.id, w.id+workers, w.id+2*workers...
+		// With fewer rows than workers, rows are shared.
+		n := (len(f.Rows) - w.id%len(f.Rows) + workers - 1) / workers
+		if n <= 0 {
+			return f.Rows[w.id%len(f.Rows)]
+		}
+		k := w.uses[i] % n
+		w.uses[i]++
+		return f.Rows[w.id%len(f.Rows)+k*workers]
+	default:
+		n := atomic.AddUint64(&f.next, 1) - 1
+		return f.Rows[n%uint64(len(f.Rows))]
+	}
+}
+
+// TemplateData is the data request templates are executed with:
+//
+//	{{ .Seq }}             sequence number of the request in the run, from 0
+//	{{ .Worker }}          index of the worker, from 0
+//	{{ .Now.Unix }}        time the request is made, a time.Time
+//	{{ .UUID }}            random UUID, unique even in seeded runs
+//	{{ .RandInt 1 100 }}   random integer in [1, 100]
+//	{{ .RandString 8 }}    random alphanumeric string of length 8
+//	{{ .Data.user_id }}    column user_id of the row of the data files
+//	{{ .Vars.token }}      value extracted into token by a previous step
+type TemplateData struct {
+	Seq    int64
+	Worker int
+	Now    time.Time
+	Data   map[string]string
+	Vars   map[string]string
+
+	rnd *rand.Rand
+}
+
+// UUID returns a random version 4 UUID. It is not drawn from the seeded
+// source of the worker, so that runs with the same seed, and servers of a
+// distributed run, do not send the same IDs.
+func (d *TemplateData) UUID() string {
+	var b [16]byte
+	crand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// RandInt returns a random integer in [min, max].
+func (d *TemplateData) RandInt(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + d.rnd.Intn(max-min+1)
+}
+
+const randChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// RandString returns a random alphanumeric string of length n.
+func (d *TemplateData) RandString(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = randChars[d.rnd.Intn(len(randChars))]
+	}
+	return string(b)
+}
+
+// requestTemplate is a request whose URL, header values and body are
+// templates. Parts that are not templates are nil.
+type requestTemplate struct {
+	url    *template.Template
+	header map[string][]*template.Template
+	body   *template.Template
+}
+
+// compileTemplate compiles the templates of req and body.
+func compileTemplate(req *http.Request, body []byte) (*requestTemplate, error) {
+	var t requestTemplate
+	var err error
+	if t.url, err = parseTemplate("url", urlTemplate(req.URL)); err != nil {
+		return nil, err
+	}
+	for k, vs := range req.Header {
+		for i, v := range vs {
+			ht, err := parseTemplate(k, v)
+			if err != nil {
+				return nil, err
+			}
+			if ht == nil {
+				continue
+			}
+			if t.header == nil {
+				t.header = make(map[string][]*template.Template)
+			}
+			if t.header[k] == nil {
+				t.header[k] = make([]*template.Template, len(vs))
+			}
+			t.header[k][i] = ht
+		}
+	}
+	if t.body, err = parseTemplate("body", string(body)); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// urlTemplate returns the template of u. The path is taken as it was
+// written, with its escaped characters, as the unescaped braces and spaces
+// of actions keep EscapedPath from returning it.
+func urlTemplate(u *url.URL) string {
+	path := u.EscapedPath()
+	if p, err := url.PathUnescape(u.RawPath); err == nil && u.RawPath != "" && p == u.Path {
+		path = u.RawPath
+	}
+	var b strings.Builder
+	b.WriteString(u.Scheme + "://")
+	if u.User != nil {
+		b.WriteString(u.User.String() + "@")
+	}
+	b.WriteString(u.Host + path)
+	if u.ForceQuery || u.RawQuery != "" {
+		b.WriteString("?" + u.RawQuery)
+	}
+	if u.Fragment != "" {
+		b.WriteString("#" + u.EscapedFragment())
+	}
+	return b.String()
+}
+
+// parseTemplate parses s, or returns nil if s is not a template.
+func parseTemplate(name, s string) (*template.Template, error) {
+	if !strings.Contains(s, "{{") {
+		return nil, nil
+	}
+	t, err := template.New(name).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// execute fills the templates of r, a clone of the template request, and
+// returns its body, or nil if the body is not a template.
+func (t *requestTemplate) execute(r *http.Request, data *TemplateData) ([]byte, error) {
+	var buf bytes.Buffer
+	if t.url != nil {
+		if err := t.url.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(buf.String())
+		if err != nil {
+			return nil, err
+		}
+		r.URL = u
+	}
+	for k, ts := range t.header {
+		for i, ht := range ts {
+			if ht == nil {
+				continue
+			}
+			buf.Reset()
+			if err := ht.Execute(&buf, data); err != nil {
+				return nil, err
+			}
+			r.Header[k][i] = buf.String()
+		}
+	}
+	if t.body == nil {
+		return nil, nil
+	}
+	buf.Reset()
+	if err := t.body.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
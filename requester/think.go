@@ -0,0 +1,154 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Think time distributions.
+const (
+	ThinkFixed       = "fixed"
+	ThinkUniform     = "uniform"
+	ThinkNormal      = "normal"
+	ThinkExponential = "exponential"
+)
+
+// ThinkTime describes the pause a worker takes between two requests.
+type ThinkTime struct {
+	// Distribution is one of "fixed", "uniform", "normal" or "exponential".
+	Distribution string
+
+	// Mean is the think time of the fixed distribution and the mean of the
+	// normal and exponential distributions.
+	Mean time.Duration
+
+	// StdDev is the standard deviation of the normal distribution.
+	StdDev time.Duration
+
+	// Min and Max are the bounds of the uniform distribution.
+	Min time.Duration
+	Max time.Duration
+}
+
+// ParseThinkTime parses a think time in the form "<distribution>:<args>":
+//
+//	fixed:200ms
+//	uniform:100ms-500ms
+//	normal:300ms,50ms (mean, standard deviation)
+//	exponential:200ms (mean)
+//
+// A bare duration such as "200ms" is a fixed think time.
+func ParseThinkTime(s string) (*ThinkTime, error) {
+	dist, args := ThinkFixed, s
+	if i := strings.Index(s, ":"); i >= 0 {
+		dist, args = s[:i], s[i+1:]
+	}
+	switch dist {
+	case ThinkFixed:
+		ds, err := parseDurations(args, ",", 1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid think time %q: %v", s, err)
+		}
+		return &ThinkTime{Distribution: ThinkFixed, Mean: ds[0]}, nil
+	case ThinkUniform:
+		ds, err := parseDurations(args, "-", 2)
+		if err != nil || ds[0] > ds[1] {
+			return nil, fmt.Errorf("invalid think time %q, want uniform:<min>-<max>", s)
+		}
+		return &ThinkTime{Distribution: ThinkUniform, Min: ds[0], Max: ds[1]}, nil
+	case ThinkNormal:
+		ds, err := parseDurations(args, ",", 2)
+		if err != nil {
+			return nil, fmt.Errorf("invalid think time %q, want normal:<mean>,<stddev>", s)
+		}
+		return &ThinkTime{Distribution: ThinkNormal, Mean: ds[0], StdDev: ds[1]}, nil
+	case ThinkExponential, "exp":
+		ds, err := parseDurations(args, ",", 1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid think time %q: %v", s, err)
+		}
+		return &ThinkTime{Distribution: ThinkExponential, Mean: ds[0]}, nil
+	}
+	return nil, fmt.Errorf("unknown think time distribution %q", dist)
+}
+
+func parseDurations(s, sep string, n int) ([]time.Duration, error) {
+	parts := strings.Split(s, sep)
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d durations, found %d", n, len(parts))
+	}
+	ds := make([]time.Duration, n)
+	for i, p := range parts {
+		d, err := time.ParseDuration(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("negative duration %v", d)
+		}
+		ds[i] = d
+	}
+	return ds, nil
+}
+
+// next returns the next think time drawn from the distribution.
+func (t *ThinkTime) next(r *rand.Rand) time.Duration {
+	var d time.Duration
+	switch t.Distribution {
+	case ThinkUniform:
+		d = t.Min
+		if t.Max > t.Min {
+			d += time.Duration(r.Int63n(int64(t.Max - t.Min)))
+		}
+	case ThinkNormal:
+		d = time.Duration(r.NormFloat64()*float64(t.StdDev)) + t.Mean
+	case ThinkExponential:
+		d = time.Duration(r.ExpFloat64() * float64(t.Mean))
+	default:
+		d = t.Mean
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// mean returns the expected think time of the distribution.
+func (t *ThinkTime) mean() time.Duration {
+	if t.Distribution == ThinkUniform {
+		return (t.Min + t.Max) / 2
+	}
+	return t.Mean
+}
+
+// sleep pauses for d and reports whether it wasn't interrupted by ctx.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
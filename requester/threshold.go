@@ -0,0 +1,205 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threshold is a pass/fail criterion of a run, such as "p99<300ms".
+type Threshold struct {
+	// Name is the threshold as parsed.
+	Name string
+
+	// Metric is one of avg, min, max, p<N> such as p99 or p99.9, rps,
+	// requests, errors, error_rate or failure_rate.
+	Metric string
+
+	// Op is one of <, <=, > and >=.
+	Op string
+
+	// Value is the bound, in seconds for latencies and as a ratio for
+	// rates.
+	Value float64
+
+	percentile float64
+}
+
+// ThresholdResult is a threshold checked against a report.
+type ThresholdResult struct {
+	*Threshold
+
+	// Actual is the value of the metric in the report.
+	Actual float64
+	// NoData is set if the report has no latencies to compute it from.
+	// The threshold then does not pass.
+	NoData bool
+	Pass   bool
+}
+
+// ParseThreshold parses a threshold in the form "<metric><op><value>":
+//
+//	p99<300ms           99th percentile of the latencies
+//	avg<=100ms          average, min or max latency
+//	error_rate<0.5%     share of requests that failed with an error
+//	failure_rate<1%     share of responses that failed an assertion
+//	rps>800             requests per second, of all the servers together
+//	errors<10           number of errors, or requests>1000
+//
+// Latencies are durations, rates are percentages or ratios.
+func ParseThreshold(s string) (*Threshold, error) {
+	i := strings.IndexAny(s, "<>")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid threshold %q, want <metric><op><value> such as p99<300ms", s)
+	}
+	t := &Threshold{Name: s, Metric: strings.TrimSpace(s[:i]), Op: s[i : i+1]}
+	value := s[i+1:]
+	if strings.HasPrefix(value, "=") {
+		t.Op += "="
+		value = value[1:]
+	}
+	value = strings.TrimSpace(value)
+
+	var err error
+	switch m := t.Metric; {
+	case m == "avg" || m == "min" || m == "max" || strings.HasPrefix(m, "p"):
+		if strings.HasPrefix(m, "p") {
+			t.percentile, err = strconv.ParseFloat(m[1:], 64)
+			if err != nil || t.percentile <= 0 || t.percentile > 100 {
+				return nil, fmt.Errorf("invalid threshold %q: invalid percentile %q", s, m)
+			}
+		}
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		t.Value = d.Seconds()
+	case m == "error_rate" || m == "failure_rate":
+		if strings.HasSuffix(value, "%") {
+			t.Value, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			t.Value /= 100
+		} else {
+			t.Value, err = strconv.ParseFloat(value, 64)
+		}
+	case m == "rps" || m == "requests" || m == "errors":
+		t.Value, err = strconv.ParseFloat(value, 64)
+	default:
+		return nil, fmt.Errorf("invalid threshold %q: unknown metric %q", s, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold %q: invalid value %q", s, value)
+	}
+	return t, nil
+}
+
+// latency reports whether the metric of t is a latency.
+func (t *Threshold) latency() bool {
+	return t.Metric == "avg" || t.Metric == "min" || t.Metric == "max" || t.percentile > 0
+}
+
+// Check checks t against r.
+func (t *Threshold) Check(r *Report) ThresholdResult {
+	v, ok := t.actual(r)
+	if !ok {
+		return ThresholdResult{Threshold: t, NoData: true}
+	}
+	pass := false
+	switch t.Op {
+	case "<":
+		pass = v < t.Value
+	case "<=":
+		pass = v <= t.Value
+	case ">":
+		pass = v > t.Value
+	case ">=":
+		pass = v >= t.Value
+	}
+	return ThresholdResult{Threshold: t, Actual: v, Pass: pass}
+}
+
+// actual returns the value of the metric in r, or false if r has no data
+// to compute it from.
+func (t *Threshold) actual(r *Report) (float64, bool) {
+	var errors int64
+	for _, n := range r.ErrorDist {
+		errors += int64(n)
+	}
+	requests := int64(len(r.Lats)) + errors
+	switch t.Metric {
+	case "rps":
+		return r.AggregateRps, true
+	case "requests":
+		return float64(requests), true
+	case "errors":
+		return float64(errors), true
+	case "error_rate":
+		if requests == 0 {
+			return 0, false
+		}
+		return float64(errors) / float64(requests), true
+	case "failure_rate":
+		if len(r.Lats) == 0 {
+			return 0, false
+		}
+		return float64(r.FailedResponses) / float64(len(r.Lats)), true
+	}
+	if len(r.Lats) == 0 {
+		return 0, false
+	}
+	switch t.Metric {
+	case "avg":
+		return r.AvgTotal, true
+	case "min":
+		return r.Fastest, true
+	case "max":
+		return r.Slowest, true
+	}
+	lats := r.Lats
+	if !sort.Float64sAreSorted(lats) {
+		lats = append([]float64(nil), lats...)
+		sort.Float64s(lats)
+	}
+	return latencyAt(lats, t.percentile), true
+}
+
+// Observed formats the actual value of the metric.
+func (r ThresholdResult) Observed() string {
+	switch {
+	case r.NoData:
+		return "no data"
+	case r.Metric == "error_rate" || r.Metric == "failure_rate":
+		return formatPercent(r.Actual)
+	case r.Metric == "rps":
+		return formatNumber(r.Actual) + " requests/sec"
+	case r.Metric == "requests" || r.Metric == "errors":
+		return strconv.FormatFloat(r.Actual, 'f', -1, 64)
+	}
+	return formatNumber(r.Actual) + " secs"
+}
+
+// CheckThresholds checks ts against r, sets r.Thresholds and reports
+// whether all of them pass.
+func (r *Report) CheckThresholds(ts []*Threshold) bool {
+	pass := true
+	r.Thresholds = nil
+	for _, t := range ts {
+		res := t.Check(r)
+		pass = pass && res.Pass
+		r.Thresholds = append(r.Thresholds, res)
+	}
+	return pass
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version such as "1.2" or "1.3".
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, want one of 1.0, 1.1, 1.2, 1.3", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses a comma-separated list of cipher suite names
+// such as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func ParseCipherSuites(s string) ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		ids[c.Name] = c.ID
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		ids[c.Name] = c.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// LoadCertPool returns a pool of the PEM encoded certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS configuration of the transport.
+func (b *Work) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		InsecureSkipVerify: !b.TLSVerify,
+		ServerName:         b.tlsServerName(),
+		RootCAs:            b.RootCAs,
+		Certificates:       b.Certificates,
+		MinVersion:         b.TLSMinVersion,
+		MaxVersion:         b.TLSMaxVersion,
+		CipherSuites:       b.TLSCipherSuites,
+	}
+	if b.TLSSessionResumption {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return cfg
+}
+
+// tlsServerName returns the SNI server name. Unless it is set explicitly,
+// the Host of the requests is used if they all share it, so that -host
+// also applies to SNI. Otherwise the transport picks the name from the
+// URL of each request.
+func (b *Work) tlsServerName() string {
+	if b.TLSServerName != "" {
+		return b.TLSServerName
+	}
+	var host string
+	for i, req := range b.Requests {
+		if i > 0 && req.Host != host {
+			return ""
+		}
+		host = req.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
@@ -0,0 +1,250 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requester
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func (b *Work) client(tr http.RoundTripper) *http.Client {
+	client := &http.Client{Transport: tr, Timeout: time.Duration(b.Timeout) * time.Second}
+	if b.DisableRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+func (b *Work) transport() http.RoundTripper {
+	if b.H2C {
+		return b.h2Transport()
+	}
+	tr := &http.Transport{
+		TLSClientConfig:     b.tlsConfig(),
+		MaxIdleConnsPerHost: min(b.C, maxIdleConn),
+		MaxConnsPerHost:     b.MaxConnsPerHost,
+		DisableCompression:  b.DisableCompression,
+		DisableKeepAlives:   b.DisableKeepAlives,
+		Proxy:               b.proxyFunc,
+		DialContext:         b.dialContext,
+	}
+	if b.H2 {
+		http2.ConfigureTransport(tr)
+	} else {
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return tr
+}
+
+// h2Transport returns an HTTP/2 only transport. It keeps a single
+// connection per host, and doesn't open more when the server's stream
+// limit is reached.
+func (b *Work) h2Transport() *http2.Transport {
+	tr := &http2.Transport{
+		TLSClientConfig:            b.tlsConfig(),
+		DisableCompression:         b.DisableCompression,
+		StrictMaxConcurrentStreams: true,
+	}
+	tr.AllowHTTP = b.H2C
+	// The connection is dialed with the context of the request that needs
+	// it, so that the dial is cancelled with the run, binds the worker's
+	// local address and reports its phases to the trace of the request.
+	tr.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		conn, err := b.dialContext(ctx, network, addr)
+		if err != nil || b.H2C {
+			// h2c speaks HTTP/2 over plain TCP, there is no TLS handshake.
+			return conn, err
+		}
+		return tlsHandshake(ctx, conn, cfg)
+	}
+	return tr
+}
+
+// tlsHandshake runs the TLS handshake of conn, and reports it to the
+// trace of ctx as the HTTP/1 transport does.
+func tlsHandshake(ctx context.Context, conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	tlsConn := tls.Client(conn, cfg)
+	err := tlsConn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connKey returns the key of the connections req can be sent on, the
+// proxy for plain HTTP requests sent to it, the scheme and host otherwise.
+func (b *Work) connKey(req *http.Request) string {
+	if u, _ := b.proxyFunc(req); u != nil {
+		return u.String()
+	}
+	return req.URL.Scheme + "://" + req.URL.Host
+}
+
+// dialContext dials the connections of the transports, through the proxy
+// unless addr is an HTTP proxy itself.
+func (b *Work) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if b.UnixSocket == "" && b.ProxyAddr != nil && (addr != b.proxyHostPort() || b.ProxyAddr.Scheme == "https") {
+		return b.dialProxy(ctx, network, addr)
+	}
+	return b.dialDirect(ctx, network, addr)
+}
+
+// dialDirect dials addr, or the Unix socket if any.
+func (b *Work) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: time.Duration(b.Timeout) * time.Second}
+	if b.UnixSocket != "" {
+		return d.DialContext(ctx, "unix", b.UnixSocket)
+	}
+	if pinned, ok := b.Resolve[addr]; ok {
+		// Dial the pinned address, there is no DNS lookup.
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(pinned, port)
+	}
+	if ip := b.localAddr(ctx); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if b.DNSServer != "" {
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, b.DNSServer)
+			},
+		}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// localAddrKey is the context key of the local address a worker is bound to.
+type localAddrKey struct{}
+
+// localAddr returns the local address to dial from, the one the worker is
+// bound to or else the next of LocalAddrs.
+func (b *Work) localAddr(ctx context.Context) net.IP {
+	if ip, ok := ctx.Value(localAddrKey{}).(net.IP); ok {
+		return ip
+	}
+	if len(b.LocalAddrs) == 0 {
+		return nil
+	}
+	i := atomic.AddUint32(&b.nextAddr, 1)
+	return b.LocalAddrs[int(i)%len(b.LocalAddrs)]
+}
+
+// ParseResolve parses a curl-style static DNS entry in the form
+// "host:port:addr", for example "example.com:443:10.0.0.1", into the
+// "host:port" it applies to and the address it resolves to.
+func ParseResolve(s string) (hostport, addr string, err error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid resolve entry %q, want host:port:addr", s)
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+	if net.ParseIP(addr) == nil {
+		return "", "", fmt.Errorf("invalid resolve entry %q, %q is not an IP address", s, parts[2])
+	}
+	return net.JoinHostPort(parts[0], parts[1]), addr, nil
+}
+
+// ParseUnixURL splits a Unix domain socket URL in the form
+// "unix:///var/run/app.sock:/path" into the socket path and the
+// path of the request, "/" if it is omitted.
+func ParseUnixURL(raw string) (socket, path string, err error) {
+	const scheme = "unix://"
+	if !strings.HasPrefix(raw, scheme) {
+		return "", "", fmt.Errorf("invalid unix socket URL %q, want unix://<socket>:<path>", raw)
+	}
+	socket, path = raw[len(scheme):], "/"
+	if i := strings.Index(socket, ":"); i >= 0 {
+		socket, path = socket[:i], socket[i+1:]
+	}
+	if socket == "" {
+		return "", "", fmt.Errorf("invalid unix socket URL %q, the socket path is empty", raw)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return socket, path, nil
+}
+
+// connTracker counts the requests carried by each connection, and the
+// peak number of requests in flight on it at once.
+type connTracker struct {
+	mu       sync.Mutex
+	active   map[net.Conn]int
+	requests map[net.Conn]int
+	peak     map[net.Conn]int
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		active:   make(map[net.Conn]int),
+		requests: make(map[net.Conn]int),
+		peak:     make(map[net.Conn]int),
+	}
+}
+
+func (t *connTracker) acquire(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active[c]++
+	t.requests[c]++
+	if t.active[c] > t.peak[c] {
+		t.peak[c] = t.active[c]
+	}
+}
+
+func (t *connTracker) release(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active[c]--; t.active[c] <= 0 {
+		delete(t.active, c)
+	}
+}
+
+// load returns the number of requests and the peak number of concurrent
+// requests of each connection.
+func (t *connTracker) load() (requests, peak []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c, n := range t.requests {
+		requests = append(requests, n)
+		peak = append(peak, t.peak[c])
+	}
+	return requests, peak
+}